@@ -0,0 +1,171 @@
+// Package auth identifies the user behind a request. The CMS has no login of
+// its own: it runs behind an authenticating reverse proxy that passes the
+// signed-in user name in a header, which is only read from requests coming
+// from a trusted proxy address. Roles are assigned from the configured
+// editor and admin lists.
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/farrell_ivander/test-conn/config"
+	"github.com/farrell_ivander/test-conn/netutil"
+)
+
+// Role is a user's permission level; higher roles include the lower ones
+type Role int
+
+const (
+	// RoleAnonymous is a request without an identified user
+	RoleAnonymous Role = iota
+	// RoleReporter is any identified user; reporters can write articles
+	RoleReporter
+	// RoleEditor can additionally take over other users' edit locks
+	RoleEditor
+	// RoleAdmin can additionally use administrative tools
+	RoleAdmin
+)
+
+// String returns the role name
+func (r Role) String() string {
+	switch r {
+	case RoleReporter:
+		return "reporter"
+	case RoleEditor:
+		return "editor"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "anonymous"
+	}
+}
+
+// User is the user making a request
+type User struct {
+	Name string
+	Role Role
+}
+
+// Anonymous reports whether the request has no identified user
+func (u *User) Anonymous() bool {
+	return u.Role == RoleAnonymous
+}
+
+// Has reports whether the user has at least the given role
+func (u *User) Has(role Role) bool {
+	return u.Role >= role
+}
+
+// MaxNameLength is the longest user name accepted, the width of the user
+// columns such as the audit log's actor
+const MaxNameLength = 100
+
+type contextKey struct{}
+
+var anonymous = &User{Role: RoleAnonymous}
+
+// Authenticator resolves users from requests
+type Authenticator struct {
+	header  string
+	proxies []netip.Prefix
+	devUser string
+	editors map[string]bool
+	admins  map[string]bool
+}
+
+// New returns an Authenticator for the given settings
+func New(cfg config.AuthConfig) (*Authenticator, error) {
+	proxies, err := cfg.TrustedProxyPrefixes()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authenticator{
+		header:  cfg.UserHeader,
+		proxies: proxies,
+		devUser: cfg.DevUser,
+		editors: make(map[string]bool),
+		admins:  make(map[string]bool),
+	}
+	for _, name := range cfg.Editors {
+		a.editors[strings.ToLower(name)] = true
+	}
+	for _, name := range cfg.Admins {
+		a.admins[strings.ToLower(name)] = true
+	}
+	return a, nil
+}
+
+// Middleware attaches the requesting user to the request context. A user
+// name longer than MaxNameLength is refused with 400.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := a.identify(r)
+		if utf8.RuneCountInString(user.Name) > MaxNameLength {
+			http.Error(w, "User name is too long", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, user)))
+	})
+}
+
+// identify resolves the user from the header set by a trusted proxy,
+// falling back to the development user when one is configured
+func (a *Authenticator) identify(r *http.Request) *User {
+	name := ""
+	if a.header != "" && netutil.FromTrustedProxy(r, a.proxies) {
+		name = strings.TrimSpace(r.Header.Get(a.header))
+	}
+	if name == "" {
+		name = a.devUser
+	}
+	if name == "" {
+		return anonymous
+	}
+
+	user := &User{Name: name, Role: RoleReporter}
+	switch key := strings.ToLower(name); {
+	case a.admins[key]:
+		user.Role = RoleAdmin
+	case a.editors[key]:
+		user.Role = RoleEditor
+	}
+	return user
+}
+
+// FromContext returns the user attached by Middleware, or an anonymous user
+func FromContext(ctx context.Context) *User {
+	if user, ok := ctx.Value(contextKey{}).(*User); ok {
+		return user
+	}
+	return anonymous
+}
+
+// Require wraps a handler so it is only served to users with at least the
+// given role. Anonymous users get 401, identified users without the role 403.
+func Require(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := FromContext(r.Context())
+		if user.Has(role) {
+			next(w, r)
+			return
+		}
+
+		if user.Anonymous() {
+			http.Error(w, "Sign in required", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Forbidden: "+role.String()+" role required", http.StatusForbidden)
+	}
+}
+
+// Requires returns Require for role as middleware for a group of routes
+func Requires(role Role) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return Require(role, next)
+	}
+}
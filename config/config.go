@@ -0,0 +1,766 @@
+// Package config loads the application configuration from defaults, an
+// optional YAML file, environment variables and command line flags.
+//
+// Sources are applied in order of increasing precedence:
+//
+//  1. built-in defaults
+//  2. the YAML config file given by -config or CONFIG_FILE
+//  3. environment variables (including those loaded from .env)
+//  4. command line flags
+//
+// A value set by a later source always overrides the earlier ones.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+
+	"github.com/farrell_ivander/test-conn/db"
+)
+
+// redacted replaces secret values when the configuration is printed
+const redacted = "********"
+
+// Config is the complete application configuration
+type Config struct {
+	Server      ServerConfig      `yaml:"server"`
+	Database    DatabaseConfig    `yaml:"database"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Editing     EditingConfig     `yaml:"editing"`
+	Media       MediaConfig       `yaml:"media"`
+	Security    SecurityConfig    `yaml:"security"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	Diagnostics DiagnosticsConfig `yaml:"diagnostics"`
+}
+
+// ServerConfig holds HTTP server settings
+type ServerConfig struct {
+	Port              string        `yaml:"port"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	DevMode           bool          `yaml:"dev_mode"`  // Serve templates and static files from disk and reload templates
+	ThemeDir          string        `yaml:"theme_dir"` // Theme whose manifest, templates and static files replace the built-in ones
+}
+
+// DatabaseConfig holds the primary database connection settings
+type DatabaseConfig struct {
+	Host           string `yaml:"host"`
+	Port           string `yaml:"port"`
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+	Name           string `yaml:"name"`
+	SSLMode        string `yaml:"ssl_mode"`
+	CACertPath     string `yaml:"ca_cert_path"`
+	ClientCertPath string `yaml:"client_cert_path"`
+	ClientKeyPath  string `yaml:"client_key_path"`
+	TLSMinVersion  string `yaml:"tls_min_version"`
+	TLSServerName  string `yaml:"tls_server_name"`
+	SkipVerify     bool   `yaml:"skip_verify"`
+
+	ConnectTimeout    time.Duration     `yaml:"connect_timeout"`
+	ReadTimeout       time.Duration     `yaml:"read_timeout"`
+	WriteTimeout      time.Duration     `yaml:"write_timeout"`
+	QueryTimeout      time.Duration     `yaml:"query_timeout"` // Limit for the queries of one model call; 0 for none
+	TimeZone          string            `yaml:"time_zone"`
+	Charset           string            `yaml:"charset"`
+	Collation         string            `yaml:"collation"`
+	InterpolateParams bool              `yaml:"interpolate_params"`
+	Params            map[string]string `yaml:"params"`
+
+	Replicas              []ReplicaConfig `yaml:"replicas"`
+	ReplicaHealthInterval time.Duration   `yaml:"replica_health_interval"`
+	ReadAfterWriteWindow  time.Duration   `yaml:"read_after_write_window"`
+}
+
+// ReplicaConfig describes a read replica; empty fields are inherited from
+// the primary database settings
+type ReplicaConfig struct {
+	Host          string `yaml:"host"`
+	Port          string `yaml:"port,omitempty"`
+	Username      string `yaml:"username,omitempty"`
+	Password      string `yaml:"password,omitempty"`
+	TLSServerName string `yaml:"tls_server_name,omitempty"`
+}
+
+// AuthConfig holds settings for identifying users. The user header must be
+// set by an authenticating reverse proxy that strips it from client requests;
+// it is only read from requests coming from one of the trusted proxies.
+type AuthConfig struct {
+	UserHeader     string   `yaml:"user_header"`
+	TrustedProxies []string `yaml:"trusted_proxies"` // Addresses or CIDR ranges
+	DevUser        string   `yaml:"dev_user"`
+	Editors        []string `yaml:"editors"`
+	Admins         []string `yaml:"admins"`
+}
+
+// EditingConfig holds settings for the article editor
+type EditingConfig struct {
+	LockTTL          time.Duration `yaml:"lock_ttl"`
+	AutosaveInterval time.Duration `yaml:"autosave_interval"`
+}
+
+// MediaConfig holds settings for image uploads, copying remote images into
+// the media library and checking hot-linked ones
+type MediaConfig struct {
+	UploadMaxBytes    int           `yaml:"upload_max_bytes"`
+	FetchTimeout      time.Duration `yaml:"fetch_timeout"`
+	FetchMaxBytes     int           `yaml:"fetch_max_bytes"`
+	FetchMaxRedirects int           `yaml:"fetch_max_redirects"`
+	FetchAllowPrivate bool          `yaml:"fetch_allow_private"` // For local stand-in servers during development
+	RecheckInterval   time.Duration `yaml:"recheck_interval"`
+}
+
+// SecurityConfig holds the security headers added to responses. CSP
+// policies may use {nonce} for the nonce of the page's inline scripts.
+type SecurityConfig struct {
+	CSP               string            `yaml:"csp"`
+	CSPReportOnly     bool              `yaml:"csp_report_only"`
+	RouteCSP          map[string]string `yaml:"route_csp"` // Policies by path prefix; empty disables CSP
+	HSTSMaxAge        time.Duration     `yaml:"hsts_max_age"`
+	FrameOptions      string            `yaml:"frame_options"`
+	ReferrerPolicy    string            `yaml:"referrer_policy"`
+	PermissionsPolicy string            `yaml:"permissions_policy"`
+}
+
+// RateLimitConfig holds request rate limits. Identified users are limited
+// by user name, anonymous clients by IP address.
+type RateLimitConfig struct {
+	Store          string `yaml:"store"`            // memory, or mysql to share limits between instances
+	ClientIPHeader string `yaml:"client_ip_header"` // Set by the reverse proxy, e.g. X-Forwarded-For
+	Read           Rate   `yaml:"read"`             // Pages, searches and the media picker
+	Write          Rate   `yaml:"write"`            // Creating, updating, deleting and uploading
+	TestConnection Rate   `yaml:"test_connection"`  // Outbound database connection tests
+}
+
+// Rate is a number of requests allowed per period, written as "60/1m". A
+// client may use the whole allowance at once. A zero count means no limit.
+type Rate struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseRate parses a rate written as "count/period", e.g. "5/10m"
+func ParseRate(value string) (Rate, error) {
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("%q is not a rate (e.g. 60/1m)", value)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n < 0 {
+		return Rate{}, fmt.Errorf("%q is not a rate: count must be a non-negative integer", value)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("%q is not a rate: period must be a positive duration", value)
+	}
+
+	return Rate{Count: n, Period: d}, nil
+}
+
+// String formats the rate as "count/period"
+func (r Rate) String() string {
+	return strconv.Itoa(r.Count) + "/" + r.Period.String()
+}
+
+// MarshalYAML writes the rate as "count/period"
+func (r Rate) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+// UnmarshalYAML reads a rate written as "count/period"
+func (r *Rate) UnmarshalYAML(node *yaml.Node) error {
+	rate, err := ParseRate(node.Value)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// DiagnosticsConfig holds settings for the admins' connection tester
+type DiagnosticsConfig struct {
+	// Hosts the tester may connect to besides the configured databases,
+	// as host (any port) or host:port
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// option binds a configuration field to its environment variable and flag.
+// An empty flag name means the value can't be set from the command line.
+type option struct {
+	env   string
+	flag  string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var options = []option{
+	{"PORT", "port", "Port to run the server on", func(c *Config) interface{} { return &c.Server.Port }},
+	{"HTTP_READ_HEADER_TIMEOUT", "read-header-timeout", "Maximum time to read request headers", func(c *Config) interface{} { return &c.Server.ReadHeaderTimeout }},
+	{"HTTP_READ_TIMEOUT", "read-timeout", "Maximum time to read the full request, including uploads", func(c *Config) interface{} { return &c.Server.ReadTimeout }},
+	{"HTTP_WRITE_TIMEOUT", "write-timeout", "Maximum time to write a response", func(c *Config) interface{} { return &c.Server.WriteTimeout }},
+	{"HTTP_IDLE_TIMEOUT", "idle-timeout", "Maximum time to keep idle keep-alive connections open", func(c *Config) interface{} { return &c.Server.IdleTimeout }},
+	{"HTTP_MAX_HEADER_BYTES", "max-header-bytes", "Maximum size of request headers in bytes", func(c *Config) interface{} { return &c.Server.MaxHeaderBytes }},
+	{"HTTP_SHUTDOWN_TIMEOUT", "shutdown-timeout", "Time allowed for in-flight requests to finish on shutdown", func(c *Config) interface{} { return &c.Server.ShutdownTimeout }},
+	{"THEME_DIR", "theme-dir", "Theme directory with a theme.json manifest and templates/ and static/ files replacing the built-in ones", func(c *Config) interface{} { return &c.Server.ThemeDir }},
+	{"DEV_MODE", "dev-mode", "Serve templates and static files from the working directory and reload templates when they change", func(c *Config) interface{} { return &c.Server.DevMode }},
+
+	{"DB_HOST", "db-host", "Database host", func(c *Config) interface{} { return &c.Database.Host }},
+	{"DB_PORT", "db-port", "Database port", func(c *Config) interface{} { return &c.Database.Port }},
+	{"DB_USERNAME", "db-username", "Database user", func(c *Config) interface{} { return &c.Database.Username }},
+	{"DB_PASSWORD", "", "", func(c *Config) interface{} { return &c.Database.Password }},
+	{"DB_NAME", "db-name", "Database name", func(c *Config) interface{} { return &c.Database.Name }},
+	{"DB_SSL_MODE", "db-ssl-mode", "Database SSL mode: disabled, preferred, required, verify-ca or verify-identity", func(c *Config) interface{} { return &c.Database.SSLMode }},
+	{"DB_CA_CERT_PATH", "db-ca-cert-path", "Path to the database CA certificate", func(c *Config) interface{} { return &c.Database.CACertPath }},
+	{"DB_CLIENT_CERT_PATH", "db-client-cert-path", "Path to the client certificate for mutual TLS", func(c *Config) interface{} { return &c.Database.ClientCertPath }},
+	{"DB_CLIENT_KEY_PATH", "db-client-key-path", "Path to the client private key for mutual TLS", func(c *Config) interface{} { return &c.Database.ClientKeyPath }},
+	{"DB_TLS_MIN_VERSION", "db-tls-min-version", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3", func(c *Config) interface{} { return &c.Database.TLSMinVersion }},
+	{"DB_TLS_SERVER_NAME", "db-tls-server-name", "Server name to verify instead of the database host", func(c *Config) interface{} { return &c.Database.TLSServerName }},
+	{"DB_SKIP_VERIFY", "db-skip-verify", "Skip database certificate verification (testing only)", func(c *Config) interface{} { return &c.Database.SkipVerify }},
+	{"DB_CONNECT_TIMEOUT", "db-connect-timeout", "Timeout for establishing a database connection", func(c *Config) interface{} { return &c.Database.ConnectTimeout }},
+	{"DB_READ_TIMEOUT", "db-read-timeout", "I/O read timeout for database connections (0 disables)", func(c *Config) interface{} { return &c.Database.ReadTimeout }},
+	{"DB_WRITE_TIMEOUT", "db-write-timeout", "I/O write timeout for database connections (0 disables)", func(c *Config) interface{} { return &c.Database.WriteTimeout }},
+	{"DB_QUERY_TIMEOUT", "db-query-timeout", "Limit for the queries of one data access (0 disables)", func(c *Config) interface{} { return &c.Database.QueryTimeout }},
+	{"DB_TIME_ZONE", "db-time-zone", "Time zone for DATETIME and TIMESTAMP values, e.g. UTC or Local", func(c *Config) interface{} { return &c.Database.TimeZone }},
+	{"DB_CHARSET", "db-charset", "Connection character set", func(c *Config) interface{} { return &c.Database.Charset }},
+	{"DB_COLLATION", "db-collation", "Connection collation", func(c *Config) interface{} { return &c.Database.Collation }},
+	{"DB_INTERPOLATE_PARAMS", "db-interpolate-params", "Interpolate query placeholders client-side", func(c *Config) interface{} { return &c.Database.InterpolateParams }},
+	{"DB_PARAMS", "db-params", "Extra driver parameters as a query string, e.g. maxAllowedPacket=0&sql_mode=ANSI", func(c *Config) interface{} { return &c.Database.Params }},
+	{"DB_REPLICAS", "db-replicas", "Comma-separated read replica addresses (host or host:port)", func(c *Config) interface{} { return &c.Database.Replicas }},
+	{"DB_REPLICA_HEALTH_INTERVAL", "db-replica-health-interval", "Interval between read replica health checks", func(c *Config) interface{} { return &c.Database.ReplicaHealthInterval }},
+	{"DB_READ_AFTER_WRITE_WINDOW", "db-read-after-write-window", "How long a client reads from the primary after writing", func(c *Config) interface{} { return &c.Database.ReadAfterWriteWindow }},
+
+	{"AUTH_USER_HEADER", "auth-user-header", "Request header carrying the user name set by the authenticating proxy", func(c *Config) interface{} { return &c.Auth.UserHeader }},
+	{"AUTH_TRUSTED_PROXIES", "auth-trusted-proxies", "Comma-separated addresses or CIDR ranges of the proxies allowed to set the user, client IP and X-Forwarded-Proto headers", func(c *Config) interface{} { return &c.Auth.TrustedProxies }},
+	{"AUTH_DEV_USER", "auth-dev-user", "User assumed when the header is missing (local development only)", func(c *Config) interface{} { return &c.Auth.DevUser }},
+	{"AUTH_EDITORS", "auth-editors", "Comma-separated user names with the editor role", func(c *Config) interface{} { return &c.Auth.Editors }},
+	{"AUTH_ADMINS", "auth-admins", "Comma-separated user names with the admin role", func(c *Config) interface{} { return &c.Auth.Admins }},
+
+	{"EDIT_LOCK_TTL", "edit-lock-ttl", "How long an edit lock lasts without a heartbeat from the editor", func(c *Config) interface{} { return &c.Editing.LockTTL }},
+	{"EDIT_AUTOSAVE_INTERVAL", "edit-autosave-interval", "How often the article form autosaves unsaved changes", func(c *Config) interface{} { return &c.Editing.AutosaveInterval }},
+
+	{"MEDIA_UPLOAD_MAX_BYTES", "media-upload-max-bytes", "Maximum size of an uploaded image in bytes", func(c *Config) interface{} { return &c.Media.UploadMaxBytes }},
+	{"MEDIA_FETCH_TIMEOUT", "media-fetch-timeout", "Time allowed for fetching a remote image", func(c *Config) interface{} { return &c.Media.FetchTimeout }},
+	{"MEDIA_FETCH_MAX_BYTES", "media-fetch-max-bytes", "Maximum size of a fetched remote image in bytes", func(c *Config) interface{} { return &c.Media.FetchMaxBytes }},
+	{"MEDIA_FETCH_MAX_REDIRECTS", "media-fetch-max-redirects", "Maximum number of redirects followed when fetching a remote image", func(c *Config) interface{} { return &c.Media.FetchMaxRedirects }},
+	{"MEDIA_FETCH_ALLOW_PRIVATE", "media-fetch-allow-private", "Allow fetching images from private and loopback addresses (development only)", func(c *Config) interface{} { return &c.Media.FetchAllowPrivate }},
+	{"MEDIA_RECHECK_INTERVAL", "media-recheck-interval", "Interval between checks of hot-linked article images (0 disables)", func(c *Config) interface{} { return &c.Media.RecheckInterval }},
+
+	{"SECURITY_CSP", "security-csp", "Content Security Policy; {nonce} is replaced with the page's script nonce (empty disables)", func(c *Config) interface{} { return &c.Security.CSP }},
+	{"SECURITY_CSP_REPORT_ONLY", "security-csp-report-only", "Only report CSP violations instead of blocking them", func(c *Config) interface{} { return &c.Security.CSPReportOnly }},
+	{"SECURITY_ROUTE_CSP", "security-route-csp", "Content Security Policies by path prefix as a query string with ; escaped as %3B, e.g. /embed/=frame-ancestors+*", func(c *Config) interface{} { return &c.Security.RouteCSP }},
+	{"SECURITY_HSTS_MAX_AGE", "security-hsts-max-age", "Strict-Transport-Security max age for HTTPS requests (0 disables)", func(c *Config) interface{} { return &c.Security.HSTSMaxAge }},
+	{"SECURITY_FRAME_OPTIONS", "security-frame-options", "X-Frame-Options: DENY, SAMEORIGIN or empty", func(c *Config) interface{} { return &c.Security.FrameOptions }},
+	{"SECURITY_REFERRER_POLICY", "security-referrer-policy", "Referrer-Policy header", func(c *Config) interface{} { return &c.Security.ReferrerPolicy }},
+	{"SECURITY_PERMISSIONS_POLICY", "security-permissions-policy", "Permissions-Policy header", func(c *Config) interface{} { return &c.Security.PermissionsPolicy }},
+
+	{"RATE_LIMIT_STORE", "rate-limit-store", "Where rate limit counters are kept: memory, or mysql to share them between instances", func(c *Config) interface{} { return &c.RateLimit.Store }},
+	{"RATE_LIMIT_CLIENT_IP_HEADER", "rate-limit-client-ip-header", "Header with the client IP set by a trusted proxy, e.g. X-Forwarded-For (empty uses the connection address)", func(c *Config) interface{} { return &c.RateLimit.ClientIPHeader }},
+	{"RATE_LIMIT_READ", "rate-limit-read", "Page views and searches allowed per client, e.g. 120/1m (0/1m disables)", func(c *Config) interface{} { return &c.RateLimit.Read }},
+	{"RATE_LIMIT_WRITE", "rate-limit-write", "Create, update, delete and upload requests allowed per client, e.g. 30/1m", func(c *Config) interface{} { return &c.RateLimit.Write }},
+	{"RATE_LIMIT_TEST_CONNECTION", "rate-limit-test-connection", "Database connection tests allowed per client, e.g. 5/10m", func(c *Config) interface{} { return &c.RateLimit.TestConnection }},
+
+	{"DIAGNOSTICS_ALLOWED_HOSTS", "diagnostics-allowed-hosts", "Comma-separated hosts (host or host:port) the connection tester may connect to besides the configured databases", func(c *Config) interface{} { return &c.Diagnostics.AllowedHosts }},
+}
+
+// Default returns the built-in default configuration
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              "8080",
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       60 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Port:           "3306",
+			ConnectTimeout: 10 * time.Second,
+			QueryTimeout:   10 * time.Second,
+			TimeZone:       "UTC",
+			Charset:        "utf8mb4",
+			Collation:      "utf8mb4_unicode_ci",
+
+			ReplicaHealthInterval: 10 * time.Second,
+			ReadAfterWriteWindow:  10 * time.Second,
+		},
+		Auth: AuthConfig{},
+		Editing: EditingConfig{
+			LockTTL:          2 * time.Minute,
+			AutosaveInterval: 5 * time.Second,
+		},
+		Media: MediaConfig{
+			UploadMaxBytes:    10 << 20,
+			FetchTimeout:      10 * time.Second,
+			FetchMaxBytes:     10 << 20,
+			FetchMaxRedirects: 3,
+			RecheckInterval:   6 * time.Hour,
+		},
+		Security: SecurityConfig{
+			// Article images and author avatars may be hot-linked from
+			// anywhere; everything else must come from us, apart from
+			// inline scripts and theme colors carrying the page's nonce
+			CSP: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; " +
+				"img-src 'self' http: https: data:; object-src 'none'; base-uri 'self'; " +
+				"form-action 'self'; frame-ancestors 'none'; report-uri /csp-report",
+			HSTSMaxAge:        365 * 24 * time.Hour,
+			FrameOptions:      "DENY",
+			ReferrerPolicy:    "strict-origin-when-cross-origin",
+			PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		},
+		RateLimit: RateLimitConfig{
+			Store:          "memory",
+			Read:           Rate{Count: 120, Period: time.Minute},
+			Write:          Rate{Count: 30, Period: time.Minute},
+			TestConnection: Rate{Count: 5, Period: 10 * time.Minute},
+		},
+	}
+}
+
+// Load builds the configuration from all sources. args are the command line
+// arguments without the program name; any positional arguments left after
+// flag parsing are returned so callers can handle subcommands.
+func Load(name string, args []string) (*Config, []string, error) {
+	// Load environment variables from .env file
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "Path to a YAML config file")
+
+	// Flags are collected as raw strings and applied last so they override
+	// every other source
+	type flagValue struct {
+		opt   option
+		value string
+	}
+	var flagValues []flagValue
+	for _, opt := range options {
+		if opt.flag == "" {
+			continue
+		}
+		opt := opt
+		fs.Func(opt.flag, opt.usage+" (env "+opt.env+")", func(value string) error {
+			flagValues = append(flagValues, flagValue{opt, value})
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := Default()
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, opt := range options {
+		// Empty variables are treated as unset so they don't clobber
+		// values from the config file
+		value := os.Getenv(opt.env)
+		if value == "" {
+			continue
+		}
+		if err := assign(opt.field(cfg), value); err != nil {
+			return nil, nil, fmt.Errorf("invalid value for %s: %v", opt.env, err)
+		}
+	}
+
+	for _, fv := range flagValues {
+		if err := assign(fv.opt.field(cfg), fv.value); err != nil {
+			return nil, nil, fmt.Errorf("invalid value for -%s: %v", fv.opt.flag, err)
+		}
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// loadFile reads a YAML config file over the current values
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// assign parses a raw string into the field pointed to by ptr
+func assign(ptr interface{}, value string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*p = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (e.g. 30s, 5m)", value)
+		}
+		*p = d
+	case *map[string]string:
+		values, err := url.ParseQuery(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a query string (e.g. a=1&b=2)", value)
+		}
+		m := make(map[string]string, len(values))
+		for key := range values {
+			m[key] = values.Get(key)
+		}
+		*p = m
+	case *[]string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*p = list
+	case *Rate:
+		rate, err := ParseRate(value)
+		if err != nil {
+			return err
+		}
+		*p = rate
+	case *[]ReplicaConfig:
+		var replicas []ReplicaConfig
+		for _, addr := range strings.Split(value, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				host, port = addr, ""
+			}
+			replicas = append(replicas, ReplicaConfig{Host: host, Port: port})
+		}
+		*p = replicas
+	default:
+		return fmt.Errorf("unsupported field type %T", ptr)
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports every problem found
+func (c *Config) Validate() error {
+	var errs []error
+
+	if err := validatePort(c.Server.Port); err != nil {
+		errs = append(errs, fmt.Errorf("server port (PORT): %v", err))
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read header timeout (HTTP_READ_HEADER_TIMEOUT)", c.Server.ReadHeaderTimeout},
+		{"read timeout (HTTP_READ_TIMEOUT)", c.Server.ReadTimeout},
+		{"write timeout (HTTP_WRITE_TIMEOUT)", c.Server.WriteTimeout},
+		{"idle timeout (HTTP_IDLE_TIMEOUT)", c.Server.IdleTimeout},
+		{"shutdown timeout (HTTP_SHUTDOWN_TIMEOUT)", c.Server.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", d.name))
+		}
+	}
+
+	if c.Server.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("max header bytes (HTTP_MAX_HEADER_BYTES) must be positive"))
+	}
+	if c.Server.ThemeDir != "" {
+		if info, err := os.Stat(c.Server.ThemeDir); err != nil {
+			errs = append(errs, fmt.Errorf("theme directory (THEME_DIR): %v", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("theme directory (THEME_DIR): %s is not a directory", c.Server.ThemeDir))
+		}
+	}
+
+	errs = append(errs, c.Database.validate()...)
+
+	if _, err := c.Auth.TrustedProxyPrefixes(); err != nil {
+		errs = append(errs, fmt.Errorf("trusted proxies (AUTH_TRUSTED_PROXIES): %v", err))
+	}
+	if c.Auth.UserHeader != "" && len(c.Auth.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("trusted proxies (AUTH_TRUSTED_PROXIES) are required with a user header (AUTH_USER_HEADER)"))
+	}
+	if c.RateLimit.ClientIPHeader != "" && len(c.Auth.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("trusted proxies (AUTH_TRUSTED_PROXIES) are required with a client IP header (RATE_LIMIT_CLIENT_IP_HEADER)"))
+	}
+
+	if c.Editing.LockTTL < 10*time.Second {
+		errs = append(errs, errors.New("edit lock TTL (EDIT_LOCK_TTL) must be at least 10s"))
+	}
+	if c.Editing.AutosaveInterval < time.Second {
+		errs = append(errs, errors.New("autosave interval (EDIT_AUTOSAVE_INTERVAL) must be at least 1s"))
+	}
+
+	// Media is stored in MEDIUMBLOB columns
+	if c.Media.UploadMaxBytes <= 0 || c.Media.UploadMaxBytes > 1<<24-1 {
+		errs = append(errs, errors.New("media upload max bytes (MEDIA_UPLOAD_MAX_BYTES) must be between 1 and 16777215"))
+	}
+	if c.Media.FetchTimeout <= 0 {
+		errs = append(errs, errors.New("media fetch timeout (MEDIA_FETCH_TIMEOUT) must be positive"))
+	}
+	if c.Media.FetchMaxBytes <= 0 || c.Media.FetchMaxBytes > 1<<24-1 {
+		errs = append(errs, errors.New("media fetch max bytes (MEDIA_FETCH_MAX_BYTES) must be between 1 and 16777215"))
+	}
+	if c.Media.FetchMaxRedirects < 0 {
+		errs = append(errs, errors.New("media fetch max redirects (MEDIA_FETCH_MAX_REDIRECTS) can't be negative"))
+	}
+	if c.Media.RecheckInterval != 0 && c.Media.RecheckInterval < time.Minute {
+		errs = append(errs, errors.New("media recheck interval (MEDIA_RECHECK_INTERVAL) must be 0 or at least 1m"))
+	}
+
+	if c.Security.HSTSMaxAge < 0 {
+		errs = append(errs, errors.New("HSTS max age (SECURITY_HSTS_MAX_AGE) can't be negative"))
+	}
+	switch c.Security.FrameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		errs = append(errs, fmt.Errorf("frame options (SECURITY_FRAME_OPTIONS) must be DENY, SAMEORIGIN or empty, not %q", c.Security.FrameOptions))
+	}
+	for prefix := range c.Security.RouteCSP {
+		if !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("route CSP path (SECURITY_ROUTE_CSP) must start with /, not %q", prefix))
+		}
+	}
+
+	if c.RateLimit.Store != "memory" && c.RateLimit.Store != "mysql" {
+		errs = append(errs, fmt.Errorf("rate limit store (RATE_LIMIT_STORE) must be memory or mysql, not %q", c.RateLimit.Store))
+	}
+	for _, rate := range []struct {
+		env  string
+		rate Rate
+	}{
+		{"RATE_LIMIT_READ", c.RateLimit.Read},
+		{"RATE_LIMIT_WRITE", c.RateLimit.Write},
+		{"RATE_LIMIT_TEST_CONNECTION", c.RateLimit.TestConnection},
+	} {
+		if rate.rate.Count < 0 || rate.rate.Period <= 0 {
+			errs = append(errs, fmt.Errorf("rate limit (%s) must be a count per positive period, e.g. 60/1m", rate.env))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks the database settings
+func (d *DatabaseConfig) validate() []error {
+	var errs []error
+
+	if d.Host == "" {
+		errs = append(errs, errors.New("database host is required (DB_HOST)"))
+	}
+	if err := validatePort(d.Port); err != nil {
+		errs = append(errs, fmt.Errorf("database port (DB_PORT): %v", err))
+	}
+	if d.Username == "" {
+		errs = append(errs, errors.New("database username is required (DB_USERNAME)"))
+	}
+	if d.Name == "" {
+		errs = append(errs, errors.New("database name is required (DB_NAME)"))
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"database connect timeout (DB_CONNECT_TIMEOUT)", d.ConnectTimeout},
+		{"database read timeout (DB_READ_TIMEOUT)", d.ReadTimeout},
+		{"database write timeout (DB_WRITE_TIMEOUT)", d.WriteTimeout},
+		{"database query timeout (DB_QUERY_TIMEOUT)", d.QueryTimeout},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			errs = append(errs, fmt.Errorf("%s can't be negative", t.name))
+		}
+	}
+
+	for i, r := range d.Replicas {
+		if r.Host == "" {
+			errs = append(errs, fmt.Errorf("database replica %d: host is required (DB_REPLICAS)", i+1))
+		}
+		if r.Port != "" {
+			if err := validatePort(r.Port); err != nil {
+				errs = append(errs, fmt.Errorf("database replica %d port: %v", i+1, err))
+			}
+		}
+	}
+	if len(d.Replicas) > 0 && d.ReplicaHealthInterval <= 0 {
+		errs = append(errs, errors.New("replica health interval (DB_REPLICA_HEALTH_INTERVAL) must be positive"))
+	}
+	if d.ReadAfterWriteWindow < 0 {
+		errs = append(errs, errors.New("read after write window (DB_READ_AFTER_WRITE_WINDOW) can't be negative"))
+	}
+
+	if d.TimeZone != "" {
+		if _, err := time.LoadLocation(d.TimeZone); err != nil {
+			errs = append(errs, fmt.Errorf("database time zone (DB_TIME_ZONE): %v", err))
+		}
+	}
+
+	if d.CACertPath != "" {
+		if err := checkCACert(d.CACertPath); err != nil {
+			errs = append(errs, fmt.Errorf("database CA certificate (DB_CA_CERT_PATH): %v", err))
+			return errs
+		}
+	}
+
+	if _, err := d.Connection().TLSConfig(); err != nil {
+		errs = append(errs, fmt.Errorf("database TLS settings (DB_SSL_MODE): %v", err))
+	}
+
+	return errs
+}
+
+// validatePort checks that port is a valid TCP port number
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q is not a valid port", port)
+	}
+	return nil
+}
+
+// checkCACert verifies that path is a readable PEM certificate file
+func checkCACert(path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", path, err)
+	}
+	if !strings.Contains(string(pem), "-----BEGIN CERTIFICATE-----") {
+		return fmt.Errorf("%s does not contain a PEM encoded certificate", path)
+	}
+	return nil
+}
+
+// TrustedProxyPrefixes parses the trusted proxies. A single address is a
+// range of one.
+func (a *AuthConfig) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range a.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR range", proxy)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Connection returns the database connection described by the configuration
+func (d *DatabaseConfig) Connection() *db.DBConnection {
+	conn := &db.DBConnection{
+		Host:           d.Host,
+		Port:           d.Port,
+		Username:       d.Username,
+		Password:       d.Password,
+		DBName:         d.Name,
+		SSLMode:        d.SSLMode,
+		CACertPath:     d.CACertPath,
+		ClientCertPath: d.ClientCertPath,
+		ClientKeyPath:  d.ClientKeyPath,
+		TLSMinVersion:  d.TLSMinVersion,
+		TLSServerName:  d.TLSServerName,
+		SkipVerify:     d.SkipVerify,
+
+		ConnectTimeout:    d.ConnectTimeout,
+		ReadTimeout:       d.ReadTimeout,
+		WriteTimeout:      d.WriteTimeout,
+		TimeZone:          d.TimeZone,
+		Charset:           d.Charset,
+		Collation:         d.Collation,
+		InterpolateParams: d.InterpolateParams,
+		Params:            d.Params,
+	}
+
+	for _, r := range d.Replicas {
+		conn.Replicas = append(conn.Replicas, db.Replica{
+			Host:          r.Host,
+			Port:          r.Port,
+			Username:      r.Username,
+			Password:      r.Password,
+			TLSServerName: r.TLSServerName,
+		})
+	}
+
+	return conn
+}
+
+// Redacted returns a copy of the configuration with secrets masked
+func (c *Config) Redacted() *Config {
+	out := *c
+	if out.Database.Password != "" {
+		out.Database.Password = redacted
+	}
+	out.Database.Replicas = make([]ReplicaConfig, len(c.Database.Replicas))
+	for i, r := range c.Database.Replicas {
+		if r.Password != "" {
+			r.Password = redacted
+		}
+		out.Database.Replicas[i] = r
+	}
+	return &out
+}
+
+// Print writes the effective configuration as YAML with secrets masked
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster routes queries between a primary database and its read replicas.
+// Writes always go to the primary; reads are spread over healthy replicas
+// and fall back to the primary when none are available.
+type Cluster struct {
+	primary  *sql.DB
+	replicas []*replicaPool
+	next     uint32
+}
+
+// replicaPool is a read-only database tracked by health checks
+type replicaPool struct {
+	addr    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// ReplicaConnection returns the connection for replica i. Credentials, the
+// database name and TLS settings are inherited from the primary unless the
+// replica overrides them.
+func (c *DBConnection) ReplicaConnection(i int) *DBConnection {
+	r := c.Replicas[i]
+
+	conn := *c
+	conn.Replicas = nil
+	conn.Host = r.Host
+	conn.TLSServerName = r.TLSServerName
+	if r.Port != "" {
+		conn.Port = r.Port
+	}
+	if r.Username != "" {
+		conn.Username = r.Username
+		conn.Password = r.Password
+	}
+
+	return &conn
+}
+
+// OpenCluster connects to the primary and all configured replicas. An
+// unreachable primary is an error; an unreachable replica is only marked
+// unhealthy so reads fall back to the primary until it recovers. ctx limits
+// the pings checking the connections.
+func OpenCluster(ctx context.Context, c *DBConnection) (*Cluster, error) {
+	primary, err := c.GetDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := &Cluster{primary: primary}
+
+	for i := range c.Replicas {
+		conn := c.ReplicaConnection(i)
+		addr := conn.Host + ":" + conn.Port
+
+		dsn, err := conn.DSN()
+		if err != nil {
+			cluster.Close()
+			return nil, fmt.Errorf("replica %s: %v", addr, err)
+		}
+
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			cluster.Close()
+			return nil, fmt.Errorf("replica %s: error opening database: %v", addr, err)
+		}
+		configurePool(db)
+
+		r := &replicaPool{addr: addr, db: db}
+		if err := db.PingContext(ctx); err != nil {
+			log.Printf("Replica %s is unavailable, reads will use the primary: %v", addr, err)
+		} else {
+			r.healthy.Store(true)
+		}
+
+		cluster.replicas = append(cluster.replicas, r)
+	}
+
+	return cluster, nil
+}
+
+// Primary returns the primary database, used for writes and for reads that
+// must see the latest data
+func (c *Cluster) Primary() *sql.DB {
+	return c.primary
+}
+
+// Reader returns a healthy replica in round-robin order, or the primary when
+// no replica is healthy
+func (c *Cluster) Reader() *sql.DB {
+	n := len(c.replicas)
+	if n == 0 {
+		return c.primary
+	}
+
+	start := atomic.AddUint32(&c.next, 1)
+	for i := 0; i < n; i++ {
+		r := c.replicas[(int(start)+i)%n]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+
+	return c.primary
+}
+
+// MonitorReplicas pings every replica at the given interval and updates its
+// health until ctx is cancelled
+func (c *Cluster) MonitorReplicas(ctx context.Context, interval time.Duration) {
+	if len(c.replicas) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, r := range c.replicas {
+				c.checkReplica(ctx, r, interval)
+			}
+		}
+	}
+}
+
+// checkReplica pings a replica and logs health transitions
+func (c *Cluster) checkReplica(ctx context.Context, r *replicaPool, timeout time.Duration) {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := r.db.PingContext(pingCtx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	healthy := err == nil
+	if r.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Printf("Replica %s recovered", r.addr)
+		} else {
+			log.Printf("Replica %s failed health check, reads will use the primary: %v", r.addr, err)
+		}
+	}
+}
+
+// Close closes the primary and all replica pools
+func (c *Cluster) Close() error {
+	var errs []error
+	if err := c.primary.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, r := range c.replicas {
+		if err := r.db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %v", r.addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -1,115 +1,117 @@
 package db
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"database/sql"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"net"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	_ "github.com/go-sql-driver/mysql"
 )
 
 // DBConnection represents a database connection
 type DBConnection struct {
-	Host       string
-	Port       string
-	Username   string
-	Password   string
-	DBName     string
-	SSLMode    string
-	CACertPath string
-	SkipVerify bool
+	Host           string
+	Port           string
+	Username       string
+	Password       string
+	DBName         string
+	SSLMode        string
+	CACertPath     string
+	ClientCertPath string
+	ClientKeyPath  string
+	TLSMinVersion  string
+	TLSServerName  string
+	SkipVerify     bool
+
+	// Driver settings; zero values leave the driver defaults in place
+	ConnectTimeout    time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	TimeZone          string
+	Charset           string
+	Collation         string
+	InterpolateParams bool
+	Params            map[string]string
+
+	// Read replicas of this (primary) database
+	Replicas []Replica
 }
 
-// NewConnectionFromEnv creates a new DBConnection from environment variables
-func NewConnectionFromEnv() *DBConnection {
-	return &DBConnection{
-		Host:       os.Getenv("DB_HOST"),
-		Port:       os.Getenv("DB_PORT"),
-		Username:   os.Getenv("DB_USERNAME"),
-		Password:   os.Getenv("DB_PASSWORD"),
-		DBName:     os.Getenv("DB_NAME"),
-		SSLMode:    os.Getenv("DB_SSL_MODE"),
-		CACertPath: os.Getenv("DB_CA_CERT_PATH"),
-		SkipVerify: os.Getenv("DB_SKIP_VERIFY") == "true",
-	}
+// Replica describes a read replica. Empty fields are inherited from the
+// primary connection, except TLSServerName which defaults to the replica host.
+type Replica struct {
+	Host          string
+	Port          string
+	Username      string
+	Password      string
+	TLSServerName string
 }
 
 // DSN returns the Data Source Name for database connection
-func (c *DBConnection) DSN() string {
-	// MySQL format: username:password@tcp(host:port)/dbname?tls=true
-	tlsConfig := "false"
-
-	if c.SSLMode == "require" || c.SSLMode == "true" {
-		if c.CACertPath != "" {
-			// Use custom TLS config with CA cert
-			tlsConfig = "custom"
-
-			// Register TLS config
-			rootCertPool := x509.NewCertPool()
-			pem, err := ioutil.ReadFile(c.CACertPath)
-			if err == nil {
-				if ok := rootCertPool.AppendCertsFromPEM(pem); ok {
-					mysql.RegisterTLSConfig("custom", &tls.Config{
-						RootCAs:            rootCertPool,
-						InsecureSkipVerify: c.SkipVerify,
-					})
-				}
-			}
-		} else if c.SkipVerify {
-			// Skip verification mode
-			tlsConfig = "skip-verify"
-			mysql.RegisterTLSConfig("skip-verify", &tls.Config{
-				InsecureSkipVerify: true,
-			})
-		} else {
-			// Standard TLS
-			tlsConfig = "true"
-		}
+func (c *DBConnection) DSN() (string, error) {
+	tlsParam, err := c.tlsParam()
+	if err != nil {
+		return "", fmt.Errorf("invalid TLS settings: %v", err)
 	}
 
-	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?tls=%s&parseTime=true",
-		c.Username, c.Password, c.Host, c.Port, c.DBName, tlsConfig)
-}
+	// Let the driver do the formatting so credentials containing @, / or :
+	// are escaped correctly
+	cfg := mysql.NewConfig()
+	cfg.User = c.Username
+	cfg.Passwd = c.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(c.Host, c.Port)
+	cfg.DBName = c.DBName
+	cfg.TLSConfig = tlsParam
+	cfg.ParseTime = true
+	cfg.Timeout = c.ConnectTimeout
+	cfg.ReadTimeout = c.ReadTimeout
+	cfg.WriteTimeout = c.WriteTimeout
+	cfg.Collation = c.Collation
+	cfg.InterpolateParams = c.InterpolateParams
+
+	if c.TimeZone != "" {
+		loc, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return "", fmt.Errorf("invalid time zone %q: %v", c.TimeZone, err)
+		}
+		cfg.Loc = loc
+	}
 
-// TestConnection attempts to connect to the database and returns error if unsuccessful
-func (c *DBConnection) TestConnection() error {
-	db, err := sql.Open("mysql", c.DSN())
-	if err != nil {
-		return fmt.Errorf("error opening database: %v", err)
+	// Extra parameters are passed through to the driver, which applies the
+	// ones it knows and sends the rest as session variables
+	if len(c.Params) > 0 || c.Charset != "" {
+		cfg.Params = make(map[string]string, len(c.Params)+1)
+		for key, value := range c.Params {
+			cfg.Params[key] = value
+		}
+		if c.Charset != "" {
+			cfg.Params["charset"] = c.Charset
+		}
 	}
-	defer db.Close()
 
-	// Set connection timeout
-	db.SetConnMaxLifetime(5 * time.Second)
+	return cfg.FormatDSN(), nil
+}
 
-	// Test the connection
-	err = db.Ping()
+// GetDB returns a database connection, checked with a ping that ctx can
+// cancel
+func (c *DBConnection) GetDB(ctx context.Context) (*sql.DB, error) {
+	dsn, err := c.DSN()
 	if err != nil {
-		return fmt.Errorf("error connecting to database: %v", err)
+		return nil, err
 	}
 
-	return nil
-}
-
-// GetDB returns a database connection
-func (c *DBConnection) GetDB() (*sql.DB, error) {
-	db, err := sql.Open("mysql", c.DSN())
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("error opening database: %v", err)
 	}
 
-	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	configurePool(db)
 
 	// Test the connection
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("error connecting to database: %v", err)
@@ -117,3 +119,10 @@ func (c *DBConnection) GetDB() (*sql.DB, error) {
 
 	return db, nil
 }
+
+// configurePool applies the connection pool settings
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(5 * time.Minute)
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDSNEscapesCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"plain", "app", "secret"},
+		{"at sign", "app", "p@ss@word"},
+		{"colon", "app", "pa:ss"},
+		{"slash", "app", "pa/ss/"},
+		{"question mark", "app", "pa?ss=1&x=2"},
+		{"percent", "app", "100%25%"},
+		{"unicode", "app", "pässwörd-密码"},
+		{"every special character", "user@host", "@:/?%#&="},
+		{"empty", "app", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &DBConnection{
+				Host:     "db.example.com",
+				Port:     "3306",
+				Username: tt.username,
+				Password: tt.password,
+				DBName:   "articles",
+			}
+
+			dsn, err := conn.DSN()
+			if err != nil {
+				t.Fatalf("DSN() error: %v", err)
+			}
+
+			cfg, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatalf("ParseDSN(%q) error: %v", dsn, err)
+			}
+			if cfg.User != tt.username {
+				t.Errorf("User = %q, want %q", cfg.User, tt.username)
+			}
+			if cfg.Passwd != tt.password {
+				t.Errorf("Passwd = %q, want %q", cfg.Passwd, tt.password)
+			}
+			if cfg.Addr != "db.example.com:3306" {
+				t.Errorf("Addr = %q, want %q", cfg.Addr, "db.example.com:3306")
+			}
+			if cfg.DBName != "articles" {
+				t.Errorf("DBName = %q, want %q", cfg.DBName, "articles")
+			}
+		})
+	}
+}
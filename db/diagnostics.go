@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// pings is the number of round trips timed by Diagnose
+const pings = 3
+
+// Diagnostics describes a database server as seen over a fresh connection
+type Diagnostics struct {
+	ServerVersion string        `json:"server_version"`
+	TLSVersion    string        `json:"tls_version"` // Empty if the connection isn't encrypted
+	TLSCipher     string        `json:"tls_cipher"`
+	ConnectTime   time.Duration `json:"connect_time"`
+	RoundTrip     time.Duration `json:"round_trip"` // Average over a few pings
+	Database      string        `json:"database"`
+	Charset       string        `json:"charset"`
+	Collation     string        `json:"collation"`
+
+	// PendingMigrations lists migrations not applied to the database.
+	// MigrationError is set instead when they couldn't be checked.
+	PendingMigrations []string `json:"pending_migrations"`
+	MigrationError    string   `json:"migration_error,omitempty"`
+}
+
+// Diagnose connects to the database and reports on the server and the
+// connection. It returns an error only if the connection fails.
+func (c *DBConnection) Diagnose(ctx context.Context) (*Diagnostics, error) {
+	dsn, err := c.DSN()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	// A single connection, so the session status below describes the
+	// connection that was timed
+	db.SetMaxOpenConns(1)
+
+	var d Diagnostics
+
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("error connecting to database: %v", err)
+	}
+	d.ConnectTime = time.Since(start)
+
+	start = time.Now()
+	for i := 0; i < pings; i++ {
+		if err := db.PingContext(ctx); err != nil {
+			return nil, fmt.Errorf("error pinging database: %v", err)
+		}
+	}
+	d.RoundTrip = time.Since(start) / pings
+
+	var database sql.NullString
+	err = db.QueryRowContext(ctx,
+		"SELECT VERSION(), DATABASE(), @@character_set_connection, @@collation_connection",
+	).Scan(&d.ServerVersion, &database, &d.Charset, &d.Collation)
+	if err != nil {
+		return nil, fmt.Errorf("error querying server details: %v", err)
+	}
+	d.Database = database.String
+
+	rows, err := db.QueryContext(ctx, "SHOW SESSION STATUS WHERE Variable_name IN ('Ssl_version', 'Ssl_cipher')")
+	if err != nil {
+		return nil, fmt.Errorf("error querying TLS status: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("error querying TLS status: %v", err)
+		}
+		switch name {
+		case "Ssl_version":
+			d.TLSVersion = value
+		case "Ssl_cipher":
+			d.TLSCipher = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying TLS status: %v", err)
+	}
+	rows.Close()
+
+	if d.Database == "" {
+		d.MigrationError = "no database selected"
+	} else if d.PendingMigrations, err = PendingMigrations(ctx, db); err != nil {
+		d.MigrationError = err.Error()
+	}
+
+	return &d, nil
+}
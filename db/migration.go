@@ -1,33 +1,156 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+
+	"github.com/farrell_ivander/test-conn/models"
 )
 
+// migration is a schema change. Migrations recorded in schema_migrations
+// are not run again. Every migration also checks the schema before
+// changing it, so databases set up before migrations were recorded are
+// brought up to date safely.
+type migration struct {
+	name string
+	run  func(ctx context.Context, db *sql.DB) error
+}
+
+// migrations are run in order. Append new migrations at the end and never
+// rename one: the names of applied migrations are recorded in
+// schema_migrations.
+var migrations = []migration{
+	{"create_articles", createArticlesTableIfNotExists},
+	{"update_articles_schema", updateArticlesTableSchema},
+	{"add_article_version", addArticleVersionColumn},
+	{"create_article_locks", createArticleLocksTableIfNotExists},
+	{"create_article_drafts", createArticleDraftsTableIfNotExists},
+	{"create_authors", createAuthorsTablesIfNotExists},
+	{"widen_author_columns", widenAuthorColumns},
+	{"create_media", createMediaTableIfNotExists},
+	{"add_featured_media", addFeaturedMediaColumn},
+	{"move_article_images_to_media", moveArticleImagesToMedia},
+	{"add_draft_featured_media", addDraftFeaturedMediaColumn},
+	{"add_media_source_url", addMediaSourceURLColumn},
+	{"create_image_checks", createImageChecksTableIfNotExists},
+	{"create_rate_limits", createRateLimitsTableIfNotExists},
+	{"create_settings", createSettingsTableIfNotExists},
+	{"create_audit_log", createAuditLogTableIfNotExists},
+}
+
 // RunMigrations executes all necessary database migrations
-func RunMigrations(db *sql.DB) error {
+func RunMigrations(ctx context.Context, db *sql.DB) error {
 	log.Println("Running database migrations...")
 
-	if err := createArticlesTableIfNotExists(db); err != nil {
+	if err := createSchemaMigrationsTableIfNotExists(ctx, db); err != nil {
 		return err
 	}
 
-	if err := updateArticlesTableSchema(db); err != nil {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
 		return err
 	}
 
+	for _, m := range migrations {
+		if applied[m.name] {
+			continue
+		}
+		if err := m.run(ctx, db); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+
+		_, err := db.ExecContext(ctx, "INSERT IGNORE INTO schema_migrations (name) VALUES (?)", m.name)
+		if err != nil {
+			return fmt.Errorf("recording migration %s: %w", m.name, err)
+		}
+	}
+
 	log.Println("Migrations completed successfully")
 	return nil
 }
 
+// PendingMigrations returns the names of the migrations not yet applied to
+// the database, in order
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	exists, err := tableExists(ctx, db, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]bool)
+	if exists {
+		if applied, err = appliedMigrations(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if !applied[m.name] {
+			pending = append(pending, m.name)
+		}
+	}
+	return pending, nil
+}
+
+// appliedMigrations returns the names recorded in schema_migrations
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied[name] = true
+	}
+	return applied, rows.Err()
+}
+
+// createSchemaMigrationsTableIfNotExists creates the table recording which
+// migrations have been applied
+func createSchemaMigrationsTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "schema_migrations")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	log.Println("Creating schema migrations table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE schema_migrations (
+			name VARCHAR(191) PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Schema migrations table created successfully")
+	return nil
+}
+
 // createArticlesTableIfNotExists creates the articles table if it doesn't exist
-func createArticlesTableIfNotExists(db *sql.DB) error {
+func createArticlesTableIfNotExists(ctx context.Context, db *sql.DB) error {
 	log.Println("Checking for articles table...")
 
 	// Check if table exists
 	var tableName string
-	err := db.QueryRow("SHOW TABLES LIKE 'articles'").Scan(&tableName)
+	err := db.QueryRowContext(ctx, "SHOW TABLES LIKE 'articles'").Scan(&tableName)
 
 	// If no error, table exists
 	if err == nil {
@@ -43,15 +166,16 @@ func createArticlesTableIfNotExists(db *sql.DB) error {
 	// Table doesn't exist, create it
 	log.Println("Creating articles table...")
 
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE articles (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			title VARCHAR(255) NOT NULL,
 			description TEXT NOT NULL,
 			image_url VARCHAR(255),
-			author VARCHAR(100) NOT NULL,
+			author VARCHAR(255) NOT NULL,
 			image_data MEDIUMBLOB,
 			image_type VARCHAR(100),
+			version INT NOT NULL DEFAULT 1,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -66,12 +190,12 @@ func createArticlesTableIfNotExists(db *sql.DB) error {
 }
 
 // updateArticlesTableSchema updates the articles table with any missing columns
-func updateArticlesTableSchema(db *sql.DB) error {
+func updateArticlesTableSchema(ctx context.Context, db *sql.DB) error {
 	log.Println("Checking for missing columns in articles table...")
 
 	// Check if the image_data column exists
 	var columnExists bool
-	err := db.QueryRow(`
+	err := db.QueryRowContext(ctx, `
 		SELECT COUNT(*) > 0
 		FROM information_schema.COLUMNS 
 		WHERE TABLE_SCHEMA = DATABASE()
@@ -87,7 +211,7 @@ func updateArticlesTableSchema(db *sql.DB) error {
 	if !columnExists {
 		log.Println("Adding image_data and image_type columns to articles table...")
 
-		_, err = db.Exec(`
+		_, err = db.ExecContext(ctx, `
 			ALTER TABLE articles
 			ADD COLUMN image_data MEDIUMBLOB AFTER author,
 			ADD COLUMN image_type VARCHAR(100) AFTER image_data
@@ -104,3 +228,623 @@ func updateArticlesTableSchema(db *sql.DB) error {
 
 	return nil
 }
+
+// addArticleVersionColumn adds the version column used for optimistic
+// concurrency control on article edits
+func addArticleVersionColumn(ctx context.Context, db *sql.DB) error {
+	exists, err := columnExists(ctx, db, "articles", "version")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Version column already exists")
+		return nil
+	}
+
+	log.Println("Adding version column to articles table...")
+
+	_, err = db.ExecContext(ctx, `
+		ALTER TABLE articles
+		ADD COLUMN version INT NOT NULL DEFAULT 1 AFTER image_type
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Version column added successfully")
+	return nil
+}
+
+// createArticleLocksTableIfNotExists creates the table holding advisory
+// edit locks on articles
+func createArticleLocksTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "article_locks")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Article locks table already exists")
+		return nil
+	}
+
+	log.Println("Creating article locks table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE article_locks (
+			article_id INT PRIMARY KEY,
+			user_name VARCHAR(100) NOT NULL,
+			acquired_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Article locks table created successfully")
+	return nil
+}
+
+// createArticleDraftsTableIfNotExists creates the table holding autosaved
+// article form contents per user. Drafts of new articles use article_id 0.
+func createArticleDraftsTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "article_drafts")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Article drafts table already exists")
+		return nil
+	}
+
+	log.Println("Creating article drafts table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE article_drafts (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_name VARCHAR(100) NOT NULL,
+			article_id INT NOT NULL DEFAULT 0,
+			title VARCHAR(255) NOT NULL,
+			description TEXT NOT NULL,
+			image_url VARCHAR(255),
+			author TEXT NOT NULL,
+			saved_at DATETIME NOT NULL,
+			UNIQUE KEY user_article (user_name, article_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Article drafts table created successfully")
+	return nil
+}
+
+// createAuthorsTablesIfNotExists creates the authors table and the table
+// linking articles to their authors, then turns the free-text author of
+// every existing article into an author record. Until the migration is
+// recorded as applied the backfill is run again, so one that failed is
+// completed on the next start.
+func createAuthorsTablesIfNotExists(ctx context.Context, db *sql.DB) error {
+	log.Println("Creating authors tables...")
+
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS authors (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			slug VARCHAR(120) NOT NULL,
+			bio TEXT,
+			avatar_url VARCHAR(255),
+			social_links TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			UNIQUE KEY slug (slug)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS article_authors (
+			article_id INT NOT NULL,
+			author_id INT NOT NULL,
+			position INT NOT NULL DEFAULT 0,
+			PRIMARY KEY (article_id, author_id),
+			KEY author_id (author_id),
+			FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE CASCADE,
+			FOREIGN KEY (author_id) REFERENCES authors(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Authors tables created successfully")
+
+	// Every article is linked to its author, or none is
+	return models.WithTx(ctx, db, func(tx models.DBTX) error {
+		return migrateArticleAuthors(ctx, tx)
+	})
+}
+
+// migrateArticleAuthors links every article without authors to an author
+// record for its free-text author. Names are grouped by slug so "john smith"
+// and "John  Smith" become one author, named after the first variant seen,
+// or the existing author with that slug. Variants with different slugs,
+// such as "J. Smith" and "John Smith", stay separate authors; editors merge
+// them from the author form.
+func migrateArticleAuthors(ctx context.Context, db models.DBTX) error {
+	log.Println("Migrating article authors...")
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, author FROM articles
+		WHERE id NOT IN (SELECT article_id FROM article_authors)
+		ORDER BY id
+	`)
+	if err != nil {
+		return err
+	}
+
+	type articleAuthor struct {
+		id   int
+		name string
+	}
+	var articles []articleAuthor
+	for rows.Next() {
+		var a articleAuthor
+		if err := rows.Scan(&a.id, &a.name); err != nil {
+			rows.Close()
+			return err
+		}
+		a.name = models.NormalizeAuthorName(a.name)
+		if a.name != "" {
+			articles = append(articles, a)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	authors := make(map[string]*models.Author)
+	for _, a := range articles {
+		slug := models.Slugify(a.name)
+		author, ok := authors[slug]
+		if !ok {
+			author, err = models.GetAuthorBySlug(ctx, db, slug)
+			if models.IsNotFound(err) {
+				author = &models.Author{Name: a.name, Slug: slug}
+				_, err = models.CreateAuthor(ctx, db, author)
+			}
+			if err != nil {
+				return err
+			}
+			authors[slug] = author
+		}
+
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO article_authors (article_id, author_id, position) VALUES (?, ?, 0)",
+			a.id, author.ID,
+		)
+		if err != nil {
+			return err
+		}
+
+		// Store the canonical spelling as the byline without touching updated_at
+		_, err = db.ExecContext(ctx,
+			"UPDATE articles SET author = ?, updated_at = updated_at WHERE id = ?",
+			author.Name, a.id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Migrated %d articles to %d authors", len(articles), len(authors))
+	return nil
+}
+
+// widenAuthorColumns makes room for bylines of several authors: the article
+// byline grows to 255 characters and autosaves keep one author per line
+func widenAuthorColumns(ctx context.Context, db *sql.DB) error {
+	articleType, err := columnType(ctx, db, "articles", "author")
+	if err != nil {
+		return err
+	}
+
+	if articleType == "varchar(100)" {
+		log.Println("Widening articles author column...")
+		if _, err := db.ExecContext(ctx, "ALTER TABLE articles MODIFY author VARCHAR(255) NOT NULL"); err != nil {
+			return err
+		}
+	}
+
+	draftType, err := columnType(ctx, db, "article_drafts", "author")
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(draftType, "varchar") {
+		log.Println("Widening article drafts author column...")
+		if _, err := db.ExecContext(ctx, "ALTER TABLE article_drafts MODIFY author TEXT NOT NULL"); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Author columns are up to date")
+	return nil
+}
+
+// createMediaTableIfNotExists creates the media library table
+func createMediaTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "media")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Media table already exists")
+		return nil
+	}
+
+	log.Println("Creating media table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE media (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			file_name VARCHAR(255) NOT NULL,
+			content_type VARCHAR(100) NOT NULL,
+			data MEDIUMBLOB NOT NULL,
+			alt_text VARCHAR(255),
+			caption TEXT,
+			credit VARCHAR(255),
+			uploaded_by VARCHAR(100),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Media table created successfully")
+	return nil
+}
+
+// addFeaturedMediaColumn adds the reference from articles to their featured
+// image in the media library
+func addFeaturedMediaColumn(ctx context.Context, db *sql.DB) error {
+	exists, err := columnExists(ctx, db, "articles", "featured_media_id")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Featured media column already exists")
+		return nil
+	}
+
+	log.Println("Adding featured media column to articles table...")
+
+	_, err = db.ExecContext(ctx, `
+		ALTER TABLE articles
+		ADD COLUMN featured_media_id INT NULL AFTER image_type,
+		ADD FOREIGN KEY (featured_media_id) REFERENCES media(id) ON DELETE SET NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Featured media column added successfully")
+	return nil
+}
+
+// moveArticleImagesToMedia moves images stored inline with articles into the
+// media library and makes them the articles' featured images. Each article
+// is moved in its own transaction, so an interrupted run resumes where it
+// stopped without leaving behind media no article uses.
+func moveArticleImagesToMedia(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM articles WHERE image_data IS NOT NULL AND featured_media_id IS NULL")
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		log.Println("No article images to move to the media library")
+		return nil
+	}
+
+	log.Printf("Moving %d article images to the media library...", len(ids))
+
+	for _, id := range ids {
+		if err := models.WithTx(ctx, db, func(tx models.DBTX) error {
+			return moveArticleImage(ctx, tx, id)
+		}); err != nil {
+			return fmt.Errorf("article %d: %w", id, err)
+		}
+	}
+
+	log.Println("Article images moved successfully")
+	return nil
+}
+
+// moveArticleImage moves the inline image of one article into the media
+// library. The article is locked first and skipped if another run has
+// already moved its image.
+func moveArticleImage(ctx context.Context, tx models.DBTX, id int) error {
+	var pending bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT image_data IS NOT NULL AND featured_media_id IS NULL
+		FROM articles WHERE id = ? FOR UPDATE
+	`, id).Scan(&pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil || !pending {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO media (file_name, content_type, data, alt_text)
+		SELECT CONCAT('article-', id), COALESCE(NULLIF(image_type, ''), 'application/octet-stream'), image_data, title
+		FROM articles WHERE id = ?
+	`, id)
+	if err != nil {
+		return err
+	}
+
+	mediaID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE articles
+		SET featured_media_id = ?, image_data = NULL, image_type = NULL, updated_at = updated_at
+		WHERE id = ? AND featured_media_id IS NULL
+	`, mediaID, id)
+	return err
+}
+
+// addDraftFeaturedMediaColumn lets autosaves remember the featured image
+// picked from the media library
+func addDraftFeaturedMediaColumn(ctx context.Context, db *sql.DB) error {
+	exists, err := columnExists(ctx, db, "article_drafts", "featured_media_id")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Draft featured media column already exists")
+		return nil
+	}
+
+	log.Println("Adding featured media column to article drafts table...")
+
+	_, err = db.ExecContext(ctx, `
+		ALTER TABLE article_drafts
+		ADD COLUMN featured_media_id INT NOT NULL DEFAULT 0 AFTER author
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Draft featured media column added successfully")
+	return nil
+}
+
+// addMediaSourceURLColumn adds the column recording where an asset copied
+// from a remote URL came from
+func addMediaSourceURLColumn(ctx context.Context, db *sql.DB) error {
+	exists, err := columnExists(ctx, db, "media", "source_url")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Media source URL column already exists")
+		return nil
+	}
+
+	log.Println("Adding source URL column to media table...")
+
+	_, err = db.ExecContext(ctx, `
+		ALTER TABLE media
+		ADD COLUMN source_url VARCHAR(2048) AFTER credit
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Media source URL column added successfully")
+	return nil
+}
+
+// createImageChecksTableIfNotExists creates the table recording the latest
+// check of each hot-linked article image
+func createImageChecksTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "image_checks")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Image checks table already exists")
+		return nil
+	}
+
+	log.Println("Creating image checks table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE image_checks (
+			url VARCHAR(255) PRIMARY KEY,
+			ok BOOLEAN NOT NULL,
+			error VARCHAR(255),
+			checked_at DATETIME NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Image checks table created successfully")
+	return nil
+}
+
+// createRateLimitsTableIfNotExists creates the table holding rate limit
+// buckets shared between instances
+func createRateLimitsTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "rate_limits")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Rate limits table already exists")
+		return nil
+	}
+
+	log.Println("Creating rate limits table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE rate_limits (
+			bucket_key VARCHAR(191) PRIMARY KEY,
+			tokens DOUBLE NOT NULL,
+			updated_at DATETIME(6) NOT NULL,
+			INDEX idx_rate_limits_updated_at (updated_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Rate limits table created successfully")
+	return nil
+}
+
+// createSettingsTableIfNotExists creates the table holding the site
+// settings, one row per setting
+func createSettingsTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "settings")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Settings table already exists")
+		return nil
+	}
+
+	log.Println("Creating settings table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE settings (
+			name VARCHAR(64) PRIMARY KEY,
+			value TEXT NOT NULL,
+			updated_by VARCHAR(100),
+			updated_at DATETIME NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Settings table created successfully")
+	return nil
+}
+
+// createAuditLogTableIfNotExists creates the append-only log of changes
+func createAuditLogTableIfNotExists(ctx context.Context, db *sql.DB) error {
+	exists, err := tableExists(ctx, db, "audit_log")
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("Audit log table already exists")
+		return nil
+	}
+
+	log.Println("Creating audit log table...")
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE audit_log (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			actor VARCHAR(100) NOT NULL,
+			action VARCHAR(50) NOT NULL,
+			target_type VARCHAR(50) NOT NULL,
+			target_id VARCHAR(120) NOT NULL DEFAULT '',
+			before_data MEDIUMTEXT,
+			after_data MEDIUMTEXT,
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent VARCHAR(255) NOT NULL DEFAULT '',
+			created_at DATETIME(6) NOT NULL,
+			INDEX idx_audit_log_created_at (created_at),
+			INDEX idx_audit_log_target (target_type, target_id),
+			INDEX idx_audit_log_actor (actor)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+	`)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Audit log table created successfully")
+	return nil
+}
+
+// tableExists reports whether a table exists in the current database
+func tableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) > 0
+		FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA = DATABASE()
+		AND TABLE_NAME = ?
+	`, table).Scan(&exists)
+	return exists, err
+}
+
+// columnExists reports whether a column exists in a table of the current database
+func columnExists(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) > 0
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE()
+		AND TABLE_NAME = ?
+		AND COLUMN_NAME = ?
+	`, table, column).Scan(&exists)
+	return exists, err
+}
+
+// columnType returns the lower-case type of a column, e.g. "varchar(100)"
+func columnType(ctx context.Context, db *sql.DB, table, column string) (string, error) {
+	var columnType string
+	err := db.QueryRowContext(ctx, `
+		SELECT LOWER(COLUMN_TYPE)
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE()
+		AND TABLE_NAME = ?
+		AND COLUMN_NAME = ?
+	`, table, column).Scan(&columnType)
+	return columnType, err
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// SSL modes mirroring MySQL's --ssl-mode option
+const (
+	SSLModeDisabled       = "disabled"
+	SSLModePreferred      = "preferred"
+	SSLModeRequired       = "required"
+	SSLModeVerifyCA       = "verify-ca"
+	SSLModeVerifyIdentity = "verify-identity"
+)
+
+// tlsVersions maps the accepted minimum TLS version names to their constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// registeredTLS tracks TLS configs already registered with the driver,
+// keyed by the name derived from the connection's TLS settings
+var (
+	registeredTLSMu sync.Mutex
+	registeredTLS   = map[string]bool{}
+)
+
+// NormalizeSSLMode maps an SSL mode, including the legacy "require"/"true"
+// and "disable"/"false" values, to one of the SSLMode constants
+func NormalizeSSLMode(mode string, skipVerify bool) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "disable", "disabled", "false":
+		return SSLModeDisabled, nil
+	case "preferred":
+		return SSLModePreferred, nil
+	case "required":
+		return SSLModeRequired, nil
+	case "verify-ca", "verify_ca":
+		return SSLModeVerifyCA, nil
+	case "verify-identity", "verify_identity":
+		return SSLModeVerifyIdentity, nil
+	case "require", "true":
+		// Legacy values verified the server certificate unless verification
+		// was explicitly skipped
+		if skipVerify {
+			return SSLModeRequired, nil
+		}
+		return SSLModeVerifyIdentity, nil
+	default:
+		return "", fmt.Errorf("unknown SSL mode %q (use disabled, preferred, required, verify-ca or verify-identity)", mode)
+	}
+}
+
+// sslMode returns the connection's normalized SSL mode
+func (c *DBConnection) sslMode() (string, error) {
+	mode, err := NormalizeSSLMode(c.SSLMode, c.SkipVerify)
+	if err != nil {
+		return "", err
+	}
+
+	if c.SkipVerify && (mode == SSLModeVerifyCA || mode == SSLModeVerifyIdentity) {
+		return "", fmt.Errorf("skip verify can't be combined with SSL mode %s", mode)
+	}
+
+	// Like the MySQL client, required with a CA certificate verifies the chain
+	if mode == SSLModeRequired && c.CACertPath != "" && !c.SkipVerify {
+		mode = SSLModeVerifyCA
+	}
+
+	return mode, nil
+}
+
+// TLSConfig builds the TLS configuration for the connection. It returns nil
+// when TLS is disabled or left to the driver's opportunistic preferred mode.
+func (c *DBConnection) TLSConfig() (*tls.Config, error) {
+	mode, err := c.sslMode()
+	if err != nil {
+		return nil, err
+	}
+
+	if (c.ClientCertPath == "") != (c.ClientKeyPath == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+
+	switch mode {
+	case SSLModeDisabled:
+		return nil, nil
+	case SSLModePreferred:
+		if c.ClientCertPath != "" {
+			return nil, errors.New("client certificates require SSL mode required or stricter")
+		}
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.TLSMinVersion != "" {
+		version, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown minimum TLS version %q (use 1.0, 1.1, 1.2 or 1.3)", c.TLSMinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if c.ClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertPath, c.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	var roots *x509.CertPool
+	if c.CACertPath != "" {
+		pem, err := os.ReadFile(c.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", c.CACertPath)
+		}
+	}
+
+	switch mode {
+	case SSLModeRequired:
+		// Encrypt only; the server certificate isn't checked
+		config.InsecureSkipVerify = true
+	case SSLModeVerifyCA:
+		// Verify the chain against the CA but not the host name, which the
+		// standard library can't do on its own
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyChain(cs, roots)
+		}
+	case SSLModeVerifyIdentity:
+		config.RootCAs = roots
+		config.ServerName = c.TLSServerName
+		if config.ServerName == "" {
+			config.ServerName = c.Host
+		}
+	}
+
+	return config, nil
+}
+
+// verifyChain checks the peer certificate chain against roots, or the system
+// pool when roots is nil, without checking the host name
+func verifyChain(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("server certificate verification failed: %v", err)
+	}
+
+	return nil
+}
+
+// tlsParam returns the value of the driver's tls parameter, registering a
+// custom TLS config the first time a given set of TLS settings is used
+func (c *DBConnection) tlsParam() (string, error) {
+	mode, err := c.sslMode()
+	if err != nil {
+		return "", err
+	}
+
+	switch mode {
+	case SSLModeDisabled:
+		return "false", nil
+	case SSLModePreferred:
+		if _, err := c.TLSConfig(); err != nil {
+			return "", err
+		}
+		return "preferred", nil
+	}
+
+	name := c.tlsConfigName(mode)
+
+	registeredTLSMu.Lock()
+	defer registeredTLSMu.Unlock()
+
+	if registeredTLS[name] {
+		return name, nil
+	}
+
+	config, err := c.TLSConfig()
+	if err != nil {
+		return "", err
+	}
+	if err := mysql.RegisterTLSConfig(name, config); err != nil {
+		return "", fmt.Errorf("error registering TLS config: %v", err)
+	}
+	registeredTLS[name] = true
+
+	return name, nil
+}
+
+// tlsConfigName derives a stable driver config name from the TLS settings so
+// connections with identical settings share one registration
+func (c *DBConnection) tlsConfigName(mode string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		mode,
+		c.Host,
+		c.CACertPath,
+		c.ClientCertPath,
+		c.ClientKeyPath,
+		c.TLSMinVersion,
+		c.TLSServerName,
+	}, "\x00")))
+	return "conn-" + hex.EncodeToString(sum[:8])
+}
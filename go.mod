@@ -1,10 +1,12 @@
 module github.com/farrell_ivander/test-conn
 
-go 1.21
+go 1.22
 
 require (
 	github.com/go-sql-driver/mysql v1.9.0
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/text v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farrell_ivander/test-conn/auth"
+	"github.com/farrell_ivander/test-conn/models"
+	"github.com/farrell_ivander/test-conn/netutil"
+)
+
+// audit records a change in the audit log with the user, address and user
+// agent of the request. db should be the transaction making the change, so
+// a change that can't be recorded isn't made either. before and after are
+// snapshots of the record, nil when it didn't exist.
+func (h *Handler) audit(r *http.Request, db models.DBTX, action, targetType string, targetID interface{}, before, after interface{}) error {
+	entry := &models.AuditEntry{
+		Actor:      auth.FromContext(r.Context()).Name,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   fmt.Sprint(targetID),
+		IP:         netutil.ClientIP(r, h.config.RateLimit.ClientIPHeader, h.proxies),
+		UserAgent:  r.UserAgent(),
+	}
+
+	var err error
+	if entry.Before, err = models.Snapshot(before); err != nil {
+		return err
+	}
+	if entry.After, err = models.Snapshot(after); err != nil {
+		return err
+	}
+	if err := models.RecordAudit(r.Context(), db, entry); err != nil {
+		return fmt.Errorf("recording %s in the audit log: %w", action, err)
+	}
+	return nil
+}
+
+// auditEvent records an action that isn't a database change, such as a
+// connection test. It has already happened, so it is recorded even if the
+// client has gone away, and a failure to record it is only logged.
+func (h *Handler) auditEvent(r *http.Request, action, targetType string, targetID interface{}, details interface{}) {
+	r = r.WithContext(context.WithoutCancel(r.Context()))
+	if err := h.audit(r, h.cluster.Primary(), action, targetType, targetID, nil, details); err != nil {
+		log.Printf("Failed to record %s of %s %v: %v", action, targetType, targetID, err)
+	}
+}
+
+// auditPageSize is the number of entries on a page of the audit log
+const auditPageSize = 50
+
+// auditActions are the actions recorded in the audit log, offered as a
+// filter in the viewer
+var auditActions = []string{
+	"article.create",
+	"article.update",
+	"article.delete",
+	"author.create",
+	"author.update",
+	"author.merge",
+	"media.create",
+	"media.update",
+	"lock.takeover",
+	"settings.update",
+	"connection.test",
+}
+
+// auditTargetTypes are the kinds of record the audit log refers to
+var auditTargetTypes = []string{"article", "author", "media", "settings", "connection"}
+
+// auditRow is an audit entry with the fields its change touched
+type auditRow struct {
+	models.AuditEntry
+	Changes []models.AuditChange
+}
+
+// AuditLogHandler shows the audit log, newest first, filtered by the query
+// string. With format=csv it downloads every matching entry instead.
+func (h *Handler) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := h.auditFilter(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		h.writeAuditCSV(w, r, filter)
+		return
+	}
+
+	filter.Limit = auditPageSize
+	entries, err := models.GetAuditEntries(r.Context(), h.reader(r), filter)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	rows := make([]auditRow, len(entries))
+	for i := range entries {
+		rows[i].AuditEntry = entries[i]
+		if rows[i].Changes, err = entries[i].Changes(); err != nil {
+			log.Printf("Failed to compare audit snapshots: %v", err)
+		}
+	}
+
+	// Keep the filters, but not the page, in the export and paging links
+	query := r.URL.Query()
+	query.Del("before")
+	query.Del("format")
+
+	data := map[string]interface{}{
+		"Entries":     rows,
+		"Filter":      r.URL.Query(),
+		"Actions":     auditActions,
+		"TargetTypes": auditTargetTypes,
+		"ExportQuery": "?" + withQuery(query, "format", "csv"),
+		"Paged":       filter.BeforeID > 0,
+	}
+	if len(entries) == auditPageSize {
+		data["OlderQuery"] = "?" + withQuery(query, "before", strconv.FormatInt(entries[len(entries)-1].ID, 10))
+	}
+	h.render(w, r, "audit.html", data)
+}
+
+// auditFilter reads the viewer's filters from the query string. Dates are
+// days in the site's time zone; until includes the whole day.
+func (h *Handler) auditFilter(r *http.Request) (models.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := models.AuditFilter{
+		Actor:      strings.TrimSpace(query.Get("actor")),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   strings.TrimSpace(query.Get("target_id")),
+	}
+
+	loc := h.settings.Get(r.Context()).Location()
+	if since := query.Get("since"); since != "" {
+		day, err := time.ParseInLocation("2006-01-02", since, loc)
+		if err != nil {
+			return filter, &models.ValidationError{Field: "since", Message: "since must be a date such as 2024-01-31"}
+		}
+		filter.Since = day
+	}
+	if until := query.Get("until"); until != "" {
+		day, err := time.ParseInLocation("2006-01-02", until, loc)
+		if err != nil {
+			return filter, &models.ValidationError{Field: "until", Message: "until must be a date such as 2024-01-31"}
+		}
+		filter.Until = day.AddDate(0, 0, 1)
+	}
+	if before := query.Get("before"); before != "" {
+		id, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			return filter, &models.ValidationError{Field: "before", Message: "before must be an entry ID"}
+		}
+		filter.BeforeID = id
+	}
+	return filter, nil
+}
+
+// withQuery encodes query with key set to value, leaving query unchanged
+func withQuery(query url.Values, key, value string) string {
+	copied := make(url.Values, len(query)+1)
+	for k, v := range query {
+		copied[k] = v
+	}
+	copied.Set(key, value)
+	return copied.Encode()
+}
+
+// writeAuditCSV streams the entries matching filter as a CSV download.
+// Once the first row is written a failure can only be logged, and the
+// download ends early.
+func (h *Handler) writeAuditCSV(w http.ResponseWriter, r *http.Request, filter models.AuditFilter) {
+	out := csv.NewWriter(w)
+	started := false
+	start := func() {
+		started = true
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-log-`+time.Now().UTC().Format("20060102")+`.csv"`)
+		out.Write([]string{"id", "created_at", "actor", "action", "target_type", "target_id", "ip", "user_agent", "before", "after"})
+	}
+
+	err := models.EachAuditEntry(r.Context(), h.reader(r), filter, func(entry *models.AuditEntry) error {
+		if !started {
+			start()
+		}
+		out.Write([]string{
+			strconv.FormatInt(entry.ID, 10),
+			entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+			csvCell(entry.Actor),
+			entry.Action,
+			entry.TargetType,
+			csvCell(entry.TargetID),
+			entry.IP,
+			csvCell(entry.UserAgent),
+			csvCell(entry.Before),
+			csvCell(entry.After),
+		})
+		return out.Error()
+	})
+	if err != nil && !started {
+		h.renderError(w, r, err)
+		return
+	}
+	if !started {
+		start()
+	}
+	out.Flush()
+
+	if err == nil {
+		err = out.Error()
+	}
+	if err != nil {
+		logError(r, err)
+	}
+}
+
+// csvCell keeps a value that spreadsheets would run as a formula, such as
+// an article title starting with "=", as plain text
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+// ListAuthorsHandler displays all authors
+func (h *Handler) ListAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	authors, err := models.GetAuthors(r.Context(), h.reader(r))
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	h.render(w, r, "authors.html", map[string]interface{}{
+		"Authors": authors,
+	})
+}
+
+// AuthorHandler displays an author's profile page
+func (h *Handler) AuthorHandler(w http.ResponseWriter, r *http.Request) {
+	database := h.reader(r)
+	author, err := models.GetAuthorBySlug(r.Context(), database, r.PathValue("slug"))
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	articles, err := models.GetArticlesByAuthor(r.Context(), database, author.ID)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	h.render(w, r, "author.html", map[string]interface{}{
+		"Author":         author,
+		"Articles":       articles,
+		"SocialNetworks": models.SocialNetworks,
+	})
+}
+
+// NewAuthorHandler displays the form for creating an author
+func (h *Handler) NewAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	h.render(w, r, "author_form.html", map[string]interface{}{
+		"Title":          "Create New Author",
+		"FormURL":        h.url("author.create"),
+		"SocialNetworks": models.SocialNetworks,
+		"FieldErrors":    map[string]string{},
+		"Author":         &models.Author{},
+	})
+}
+
+// CreateAuthorHandler creates an author from the author form
+func (h *Handler) CreateAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	author := authorFromForm(r)
+	data := map[string]interface{}{
+		"Title":          "Create New Author",
+		"FormURL":        h.url("author.create"),
+		"SocialNetworks": models.SocialNetworks,
+		"FieldErrors":    map[string]string{},
+		"Author":         author,
+	}
+
+	if err := author.Validate(); err != nil {
+		h.renderInvalidAuthor(w, r, data, err)
+		return
+	}
+
+	// CreateAuthor may add a suffix to the slug, so a retried attempt
+	// starts again from the slug in the form
+	formSlug := author.Slug
+	err := models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+		author.Slug = formSlug
+		if _, err := models.CreateAuthor(r.Context(), tx, author); err != nil {
+			return err
+		}
+		created, err := models.GetAuthorBySlug(r.Context(), tx, author.Slug)
+		if err != nil {
+			return err
+		}
+		return h.audit(r, tx, "author.create", "author", author.ID, nil, created)
+	})
+	if err != nil {
+		data["Error"] = errorMessage(r, "Failed to create author", err)
+		h.render(w, r, "author_form.html", data)
+		return
+	}
+
+	h.markWrite(w)
+	http.Redirect(w, r, h.url("author", author.Slug), http.StatusSeeOther)
+}
+
+// EditAuthorHandler displays the form for editing an author's profile
+func (h *Handler) EditAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	data := map[string]interface{}{
+		"Title":          "Edit Author",
+		"FormURL":        h.url("author.update", slug),
+		"SocialNetworks": models.SocialNetworks,
+		"FieldErrors":    map[string]string{},
+	}
+
+	author, err := models.GetAuthorBySlug(r.Context(), h.cluster.Primary(), slug)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	// The other authors this one can be merged into
+	authors, err := models.GetAuthors(r.Context(), h.cluster.Primary())
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	var others []models.Author
+	for _, other := range authors {
+		if other.ID != author.ID {
+			others = append(others, other)
+		}
+	}
+
+	data["Author"] = author
+	data["MergeAuthors"] = others
+	h.render(w, r, "author_form.html", data)
+}
+
+// UpdateAuthorHandler saves an author's profile. The path carries the slug
+// the author had when the form was opened, since the form may change it.
+func (h *Handler) UpdateAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	existing, err := models.GetAuthorBySlug(r.Context(), h.cluster.Primary(), slug)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	author := authorFromForm(r)
+	author.ID = existing.ID
+
+	data := map[string]interface{}{
+		"Title":          "Edit Author",
+		"FormURL":        h.url("author.update", slug),
+		"SocialNetworks": models.SocialNetworks,
+		"FieldErrors":    map[string]string{},
+		"Author":         author,
+	}
+
+	err = author.Validate()
+	if author.Slug == "" {
+		errs, _ := err.(models.ValidationErrors)
+		err = append(errs, &models.ValidationError{Field: "slug", Message: "slug is required"})
+	}
+	if err != nil {
+		h.renderInvalidAuthor(w, r, data, err)
+		return
+	}
+
+	// The profile, the bylines of the author's articles and the audit entry
+	// change together. UpdateAuthor may add a suffix to the slug, so a retried attempt
+	// starts again from the slug in the form.
+	formSlug := author.Slug
+	err = models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+		author.Slug = formSlug
+		if err := models.UpdateAuthor(r.Context(), tx, author); err != nil {
+			return err
+		}
+		updated, err := models.GetAuthorBySlug(r.Context(), tx, author.Slug)
+		if err != nil {
+			return err
+		}
+		return h.audit(r, tx, "author.update", "author", author.ID, existing, updated)
+	})
+	if fieldErrors(err) != nil {
+		// Such as a byline the new name would make too long
+		h.renderInvalidAuthor(w, r, data, err)
+		return
+	}
+	if err != nil {
+		data["Error"] = errorMessage(r, "Failed to update author", err)
+		h.render(w, r, "author_form.html", data)
+		return
+	}
+
+	h.markWrite(w)
+	http.Redirect(w, r, h.url("author", author.Slug), http.StatusSeeOther)
+}
+
+// MergeAuthorHandler merges the author in the path into the author picked
+// in the form, for one person entered under two names
+func (h *Handler) MergeAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := models.GetAuthorBySlug(r.Context(), h.cluster.Primary(), r.PathValue("slug"))
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	into, err := models.GetAuthorBySlug(r.Context(), h.cluster.Primary(), r.FormValue("into"))
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	err = models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+		if err := models.MergeAuthors(r.Context(), tx, from.ID, into.ID); err != nil {
+			return err
+		}
+		return h.audit(r, tx, "author.merge", "author", from.ID, from, into)
+	})
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	h.markWrite(w)
+	http.Redirect(w, r, h.url("author", into.Slug), http.StatusSeeOther)
+}
+
+// authorFromForm reads an author from the author form, to be checked with
+// Validate
+func authorFromForm(r *http.Request) *models.Author {
+	author := &models.Author{
+		Name:        r.FormValue("name"),
+		Bio:         r.FormValue("bio"),
+		AvatarURL:   r.FormValue("avatar_url"),
+		SocialLinks: make(map[string]string),
+	}
+
+	if slug := strings.TrimSpace(r.FormValue("slug")); slug != "" {
+		author.Slug = models.Slugify(slug)
+	}
+
+	for _, network := range models.SocialNetworks {
+		if link := strings.TrimSpace(r.FormValue("social_" + network)); link != "" {
+			author.SocialLinks[network] = link
+		}
+	}
+
+	return author
+}
+
+// renderInvalidAuthor shows the author form again with the fields err
+// reports next to their inputs
+func (h *Handler) renderInvalidAuthor(w http.ResponseWriter, r *http.Request, data map[string]interface{}, err error) {
+	fields := fieldErrors(err)
+	for field, message := range fields {
+		fields[field] = capitalize(message)
+	}
+	data["FieldErrors"] = fields
+	data["Error"] = "Please correct the errors below"
+	h.renderStatus(w, r, http.StatusUnprocessableEntity, "author_form.html", data)
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/farrell_ivander/test-conn/auth"
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+// maxDraftSize caps autosave requests, which never include image uploads
+const maxDraftSize = 1 << 20
+
+// addAutosave enables autosaving in the article form data and offers the
+// user's autosave when it is newer than the saved article. article is nil
+// for a new article.
+func (h *Handler) addAutosave(r *http.Request, article *models.Article, data map[string]interface{}) {
+	user := auth.FromContext(r.Context())
+	if user.Anonymous() {
+		return
+	}
+
+	data["AutosaveMs"] = h.config.Editing.AutosaveInterval.Milliseconds()
+
+	articleID := 0
+	if article != nil {
+		articleID = article.ID
+	}
+
+	draft, err := models.GetDraft(r.Context(), h.cluster.Primary(), user.Name, articleID)
+	if err != nil {
+		log.Printf("Failed to fetch autosave for article %d: %v", articleID, err)
+		return
+	}
+
+	if draft != nil && (article == nil || draft.SavedAt.After(article.UpdatedAt)) {
+		data["Draft"] = draft
+	}
+}
+
+// discardDraft removes the user's autosave after the article was saved
+func (h *Handler) discardDraft(r *http.Request, articleID int) {
+	user := auth.FromContext(r.Context())
+	if user.Anonymous() {
+		return
+	}
+
+	if err := models.DeleteDraft(r.Context(), h.cluster.Primary(), user.Name, articleID); err != nil {
+		log.Printf("Failed to delete autosave for article %d: %v", articleID, err)
+	}
+}
+
+// GetAutosaveHandler returns the requesting user's latest autosave of the
+// article in the path, where article 0 is the new article form
+func (h *Handler) GetAutosaveHandler(w http.ResponseWriter, r *http.Request) {
+	articleID, err := pathID(r, "article")
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	user := auth.FromContext(r.Context())
+	draft, err := models.GetDraft(r.Context(), h.cluster.Primary(), user.Name, articleID)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	if draft == nil {
+		h.renderError(w, r, &models.NotFoundError{Kind: "autosave of article", Key: articleID})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
+
+// SaveAutosaveHandler stores the article form contents as the requesting
+// user's autosave of the article in the path
+func (h *Handler) SaveAutosaveHandler(w http.ResponseWriter, r *http.Request) {
+	articleID, err := pathID(r, "article")
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxDraftSize)
+	if err := r.ParseMultipartForm(maxDraftSize); err != nil {
+		h.renderError(w, r, formError(err))
+		return
+	}
+
+	draft := &models.Draft{
+		UserName:    auth.FromContext(r.Context()).Name,
+		ArticleID:   articleID,
+		Title:       r.FormValue("title"),
+		Description: r.FormValue("description"),
+		ImageURL:    r.FormValue("image_url"),
+	}
+	for _, name := range r.Form["author"] {
+		if name = models.NormalizeAuthorName(name); name != "" {
+			draft.Authors = append(draft.Authors, name)
+		}
+	}
+	draft.FeaturedMediaID, _ = strconv.Atoi(r.FormValue("featured_media_id"))
+
+	if err := models.SaveDraft(r.Context(), h.cluster.Primary(), draft); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"saved_at": draft.SavedAt,
+	})
+}
+
+// DiscardAutosaveHandler deletes the requesting user's autosave of an article
+func (h *Handler) DiscardAutosaveHandler(w http.ResponseWriter, r *http.Request) {
+	articleID, err := pathID(r, "article")
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	user := auth.FromContext(r.Context())
+	if err := models.DeleteDraft(r.Context(), h.cluster.Primary(), user.Name, articleID); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+// internalErrorMessage is all visitors learn about unexpected failures
+const internalErrorMessage = "Something went wrong on our side. The error has been logged; please try again later."
+
+// requestError is an error about the request itself, such as a malformed
+// form, that maps to a specific HTTP status
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// badRequest returns a requestError with the given status and message
+func badRequest(status int, message string) error {
+	return &requestError{status: status, message: message}
+}
+
+// formError describes a failure to parse the request's form, which is the
+// client's fault
+func formError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return badRequest(http.StatusRequestEntityTooLarge, "request is too large")
+	}
+	return badRequest(http.StatusBadRequest, "error parsing form: "+err.Error())
+}
+
+// errorStatus returns the HTTP status for err and the message visitors may
+// see. Errors that aren't one of the models' domain errors or a
+// requestError are internal, so their message is replaced.
+func errorStatus(err error) (int, string) {
+	var (
+		notFound *models.NotFoundError
+		conflict *models.ConflictError
+		invalid  *models.ValidationError
+		request  *requestError
+	)
+
+	switch {
+	case errors.As(err, &request):
+		return request.status, err.Error()
+	case errors.As(err, &notFound):
+		return http.StatusNotFound, err.Error()
+	case errors.As(err, &conflict):
+		return http.StatusConflict, err.Error()
+	case errors.As(err, &invalid):
+		return http.StatusUnprocessableEntity, err.Error()
+	default:
+		return http.StatusInternalServerError, internalErrorMessage
+	}
+}
+
+// logError logs an internal error with the request it happened on
+func logError(r *http.Request, err error) {
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// fieldErrors maps the fields named by validation errors in err to their
+// messages
+func fieldErrors(err error) map[string]string {
+	var invalid models.ValidationErrors
+	if errors.As(err, &invalid) {
+		return invalid.Fields()
+	}
+
+	var single *models.ValidationError
+	if errors.As(err, &single) && single.Field != "" {
+		return map[string]string{single.Field: single.Message}
+	}
+	return nil
+}
+
+// renderError responds with the status and message errorStatus picks for
+// err: JSON for clients that accept it, otherwise the error page. Internal
+// errors are logged.
+func (h *Handler) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	if wantsJSON(r) {
+		writeJSONError(w, r, err)
+		return
+	}
+
+	status, message := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		logError(r, err)
+	}
+
+	h.renderStatus(w, r, status, "error.html", map[string]interface{}{
+		"Status":     status,
+		"StatusText": http.StatusText(status),
+		"Message":    capitalize(message),
+	})
+}
+
+// writeJSONError responds with {"success": false, "message": ...} and the
+// status errorStatus picks for err. Validation errors add "errors", mapping
+// each invalid field to its message.
+func writeJSONError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		logError(r, err)
+	}
+
+	body := map[string]interface{}{
+		"success": false,
+		"message": message,
+	}
+	if fields := fieldErrors(err); fields != nil {
+		body["errors"] = fields
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// errorMessage describes a failed action for a page or form that shows the
+// error inline, e.g. "Failed to save image: image is too large". Internal
+// errors are logged and only the action is named.
+func errorMessage(r *http.Request, action string, err error) string {
+	status, message := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		logError(r, err)
+		return action + ". " + internalErrorMessage
+	}
+	return action + ": " + message
+}
+
+// NotFoundHandler renders the error page for paths that match no route
+func (h *Handler) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	h.renderError(w, r, &models.NotFoundError{Kind: "page", Key: r.URL.Path})
+}
+
+// pathID parses the numeric {id} path parameter naming a kind of record. A
+// malformed ID can't name a record, so it is reported as not found.
+func pathID(r *http.Request, kind string) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0, &models.NotFoundError{Kind: kind, Key: r.PathValue("id")}
+	}
+	return id, nil
+}
+
+// capitalize upper-cases the first letter of a message for display
+func capitalize(message string) string {
+	if message == "" {
+		return message
+	}
+	return strings.ToUpper(message[:1]) + message[1:]
+}
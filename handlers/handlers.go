@@ -1,74 +1,203 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
-	"html/template"
-	"io/ioutil"
-	"mime"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
-	"path/filepath"
+	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/farrell_ivander/test-conn/auth"
+	"github.com/farrell_ivander/test-conn/config"
 	"github.com/farrell_ivander/test-conn/db"
 	"github.com/farrell_ivander/test-conn/models"
+	"github.com/farrell_ivander/test-conn/remote"
+	"github.com/farrell_ivander/test-conn/router"
+	"github.com/farrell_ivander/test-conn/security"
+	"github.com/farrell_ivander/test-conn/settings"
+	"github.com/farrell_ivander/test-conn/views"
 )
 
 // Handler holds handler dependencies
 type Handler struct {
-	templates *template.Template
+	views    *views.Renderer
+	config   *config.Config
+	cluster  *db.Cluster
+	fetcher  *remote.Fetcher
+	routes   *router.Router
+	settings *settings.Service
+	proxies  []netip.Prefix // Trusted to set the client IP header
 }
 
-// NewHandler initializes and returns a new Handler
-func NewHandler() *Handler {
-	templates := template.Must(template.ParseGlob("templates/*.html"))
+// primaryCookie marks clients that wrote recently so their reads go to the
+// primary instead of a possibly lagging replica
+const primaryCookie = "read_primary"
+
+// NewHandler initializes and returns a new Handler using the shared
+// database pools. The caller owns the cluster and is responsible for closing it.
+// Pages are rendered with pages and show the site settings of site, and
+// redirects are built from the named routes of routes.
+func NewHandler(cfg *config.Config, cluster *db.Cluster, fetcher *remote.Fetcher, routes *router.Router, pages *views.Renderer, site *settings.Service) *Handler {
+	// The proxies were checked by cfg.Validate
+	proxies, _ := cfg.Auth.TrustedProxyPrefixes()
 	return &Handler{
-		templates: templates,
+		views:    pages,
+		config:   cfg,
+		cluster:  cluster,
+		fetcher:  fetcher,
+		routes:   routes,
+		settings: site,
+		proxies:  proxies,
 	}
 }
 
-// HomeHandler handles the home page
-func (h *Handler) HomeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+// url returns the path of a named route with its parameters filled in
+func (h *Handler) url(name string, params ...interface{}) string {
+	return h.routes.MustURL(name, params...)
+}
+
+// LegacyRedirect permanently redirects the query string URLs used before
+// routes had path parameters, such as /article?id=1, to the named route.
+// The parameter is read from the old path, or from the query string.
+func (h *Handler) LegacyRedirect(name, param string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := r.PathValue(param)
+		if value == "" {
+			value = r.URL.Query().Get(param)
+		}
+		if value == "" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, h.url(name, value), http.StatusMovedPermanently)
+	}
+}
+
+// reader returns the database to use for read-only queries. Clients that
+// wrote within the read-after-write window read from the primary.
+func (h *Handler) reader(r *http.Request) *sql.DB {
+	if _, err := r.Cookie(primaryCookie); err == nil {
+		return h.cluster.Primary()
+	}
+	return h.cluster.Reader()
+}
+
+// markWrite pins the client to the primary for the read-after-write window
+// so the redirect after a write sees its own changes
+func (h *Handler) markWrite(w http.ResponseWriter) {
+	window := h.config.Database.ReadAfterWriteWindow
+	if window <= 0 {
 		return
 	}
 
-	h.templates.ExecuteTemplate(w, "index.html", nil)
+	maxAge := int(window / time.Second)
+	if maxAge < 1 {
+		maxAge = 1
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     primaryCookie,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
-// TestConnectionHandler handles database connection tests
-func (h *Handler) TestConnectionHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// render responds with a page, see renderStatus
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
+	h.renderStatus(w, r, http.StatusOK, name, data)
+}
+
+// renderStatus responds with status and a page, with the request's CSP nonce
+// added to data as .Nonce for the page's inline scripts and the site
+// settings as .Site. If the page can't be rendered the error is logged and
+// a plain 500 sent instead.
+func (h *Handler) renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, data map[string]interface{}) {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["Nonce"] = security.Nonce(r.Context())
+	data["Site"] = h.settings.Get(r.Context())
+
+	var page bytes.Buffer
+	if err := h.views.Render(&page, name, data); err != nil {
+		logError(r, fmt.Errorf("rendering %s: %w", name, err))
+		http.Error(w, internalErrorMessage, http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	page.WriteTo(w)
+}
+
+// HomeHandler handles the home page
+func (h *Handler) HomeHandler(w http.ResponseWriter, r *http.Request) {
+	h.render(w, r, "index.html", map[string]interface{}{
+		"CanTest": auth.FromContext(r.Context()).Has(auth.RoleAdmin),
+	})
+}
+
+// TestConnectionHandler connects to the configured database or an
+// allowlisted host and reports diagnostics. It is for admins only, since it
+// makes the server open connections with caller-supplied credentials.
+func (h *Handler) TestConnectionHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse form values for custom connection
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		h.renderError(w, r, formError(err))
 		return
 	}
 
 	var conn *db.DBConnection
 
-	// Check if the request wants to use environment variables
+	// Check if the request wants to use the server configuration
 	if r.FormValue("use_env") == "true" {
-		conn = db.NewConnectionFromEnv()
+		conn = h.config.Database.Connection()
 	} else {
 		// Use form-provided connection details
 		conn = &db.DBConnection{
-			Host:     r.FormValue("host"),
-			Port:     r.FormValue("port"),
+			Host:     strings.TrimSpace(r.FormValue("host")),
+			Port:     strings.TrimSpace(r.FormValue("port")),
 			Username: r.FormValue("username"),
 			Password: r.FormValue("password"),
 			DBName:   r.FormValue("dbname"),
 			SSLMode:  r.FormValue("sslmode"),
+
+			ConnectTimeout: 10 * time.Second,
+		}
+		if conn.Port == "" {
+			conn.Port = "3306"
+		}
+
+		if !h.connectionAllowed(conn.Host, conn.Port) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   net.JoinHostPort(conn.Host, conn.Port) + " is not a configured database or in DIAGNOSTICS_ALLOWED_HOSTS",
+			})
+			return
 		}
 	}
 
 	// Test the connection
-	err := conn.TestConnection()
+	diagnostics, err := conn.Diagnose(r.Context())
+	h.auditEvent(r, "connection.test", "connection", net.JoinHostPort(conn.Host, conn.Port), map[string]interface{}{
+		"use_env":  r.FormValue("use_env") == "true",
+		"username": conn.Username,
+		"dbname":   conn.DBName,
+		"success":  err == nil,
+	})
 
 	// Prepare the response
 	result := map[string]interface{}{
@@ -79,6 +208,7 @@ func (h *Handler) TestConnectionHandler(w http.ResponseWriter, r *http.Request)
 		result["error"] = err.Error()
 	} else {
 		result["message"] = "Connection successful!"
+		result["diagnostics"] = diagnostics
 	}
 
 	// Return the result as JSON
@@ -86,145 +216,133 @@ func (h *Handler) TestConnectionHandler(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(result)
 }
 
-// ListArticlesHandler handles listing and searching articles
-func (h *Handler) ListArticlesHandler(w http.ResponseWriter, r *http.Request) {
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
-	if err != nil {
-		h.templates.ExecuteTemplate(w, "articles.html", map[string]interface{}{
-			"Error": "Failed to connect to database: " + err.Error(),
-		})
-		return
+// connectionAllowed reports whether the connection tester may connect to
+// host and port: the configured primary and replicas, and the hosts in the
+// diagnostics allowlist
+func (h *Handler) connectionAllowed(host, port string) bool {
+	if host == "" {
+		return false
 	}
-	defer database.Close()
 
+	database := h.config.Database
+	allowed := []string{net.JoinHostPort(database.Host, database.Port)}
+	for _, replica := range database.Replicas {
+		replicaPort := replica.Port
+		if replicaPort == "" {
+			replicaPort = database.Port
+		}
+		allowed = append(allowed, net.JoinHostPort(replica.Host, replicaPort))
+	}
+	allowed = append(allowed, h.config.Diagnostics.AllowedHosts...)
+
+	for _, entry := range allowed {
+		allowedHost, allowedPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			// A bare host allows any port
+			allowedHost, allowedPort = entry, port
+		}
+		if strings.EqualFold(allowedHost, host) && allowedPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// ListArticlesHandler handles listing and searching articles
+func (h *Handler) ListArticlesHandler(w http.ResponseWriter, r *http.Request) {
 	searchTerm := r.URL.Query().Get("search")
 	var articles []models.Article
+	var err error
 
 	if searchTerm != "" {
 		// Search for articles
-		articles, err = models.SearchArticles(database, searchTerm)
+		articles, err = models.SearchArticles(r.Context(), h.reader(r), searchTerm)
 	} else {
-		// Get all articles (limit to 50 for performance)
-		articles, err = models.GetArticles(database, 50)
+		// Get the latest articles, as many as the page size setting allows
+		articles, err = models.GetArticles(r.Context(), h.reader(r), h.settings.Get(r.Context()).PageSize)
 	}
 
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "articles.html", map[string]interface{}{
-			"Error": "Failed to fetch articles: " + err.Error(),
-		})
+		h.renderError(w, r, err)
 		return
 	}
 
-	h.templates.ExecuteTemplate(w, "articles.html", map[string]interface{}{
-		"Articles":   articles,
-		"SearchTerm": searchTerm,
-	})
-}
-
-// GetArticleHandler handles displaying a single article
-func (h *Handler) GetArticleHandler(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
-	if idStr == "" {
-		http.Redirect(w, r, "/articles", http.StatusSeeOther)
-		return
+	// Show who is currently editing which article
+	locks, err := models.GetActiveEditLocks(r.Context(), h.reader(r))
+	if err != nil {
+		log.Printf("Failed to fetch edit locks: %v", err)
+		locks = map[int]*models.EditLock{}
 	}
 
-	id, err := strconv.Atoi(idStr)
+	// Flag hot-linked images the background check found broken
+	brokenImages, err := models.GetBrokenImages(r.Context(), h.reader(r))
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
-		return
+		log.Printf("Failed to fetch image checks: %v", err)
+		brokenImages = map[string]*models.ImageCheck{}
 	}
 
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
+	h.render(w, r, "articles.html", map[string]interface{}{
+		"Articles":     articles,
+		"SearchTerm":   searchTerm,
+		"Locks":        locks,
+		"BrokenImages": brokenImages,
+	})
+}
+
+// GetArticleHandler handles displaying a single article
+func (h *Handler) GetArticleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "article")
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "article.html", map[string]interface{}{
-			"Error": "Failed to connect to database: " + err.Error(),
-		})
+		h.renderError(w, r, err)
 		return
 	}
-	defer database.Close()
 
-	article, err := models.GetArticleByID(database, id)
+	article, err := models.GetArticleByID(r.Context(), h.reader(r), id)
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "article.html", map[string]interface{}{
-			"Error": "Failed to fetch article: " + err.Error(),
-		})
+		h.renderError(w, r, err)
 		return
 	}
 
-	h.templates.ExecuteTemplate(w, "article.html", map[string]interface{}{
+	// Clients send the ETag back in If-Match to update this version
+	w.Header().Set("ETag", articleETag(article))
+	h.render(w, r, "article.html", map[string]interface{}{
 		"Article": article,
 	})
 }
 
 // GetImageHandler serves images stored in the database
 func (h *Handler) GetImageHandler(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
-	if idStr == "" {
-		http.Error(w, "Article ID is required", http.StatusBadRequest)
-		return
-	}
-
-	id, err := strconv.Atoi(idStr)
+	id, err := pathID(r, "article")
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Connect to database
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
-	if err != nil {
-		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
-		return
-	}
-	defer database.Close()
-
 	// Get image from database
-	imageBlob, contentType, err := models.GetImageByArticleID(database, id)
+	imageBlob, _, err := models.GetImageByArticleID(r.Context(), h.reader(r), id)
 	if err != nil {
-		http.Error(w, "Failed to retrieve image", http.StatusNotFound)
+		h.renderError(w, r, err)
 		return
 	}
 
-	// If content type is not provided, try to guess it
-	if contentType == "" {
-		contentType = http.DetectContentType(imageBlob)
-	}
-
-	// Set content type header and write image data
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.Itoa(len(imageBlob)))
-	w.Write(imageBlob)
+	writeImage(w, imageBlob, "article-"+strconv.Itoa(id))
 }
 
 // NewArticleHandler displays the form for creating a new article
 func (h *Handler) NewArticleHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		// Display the form
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
-			"Title":   "Create New Article",
-			"FormURL": "/article/create",
-			"Article": &models.Article{},
-		})
-		return
+	data := map[string]interface{}{
+		"Title":   "Create New Article",
+		"FormURL": h.url("article.create"),
+		"Article": &models.Article{},
 	}
+	h.addAutosave(r, nil, data)
 
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	h.renderArticleForm(w, r, http.StatusOK, data)
 }
 
 // CreateArticleHandler handles creating a new article
 func (h *Handler) CreateArticleHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Parse the multipart form data with 10MB max memory
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+	if !h.parseUploadForm(w, r) {
 		return
 	}
 
@@ -233,138 +351,113 @@ func (h *Handler) CreateArticleHandler(w http.ResponseWriter, r *http.Request) {
 		Title:       r.FormValue("title"),
 		Description: r.FormValue("description"),
 		ImageURL:    r.FormValue("image_url"),
-		Author:      r.FormValue("author"),
-	}
-
-	// Check if a file was uploaded
-	file, header, err := r.FormFile("image")
-	if err == nil {
-		// File was uploaded
-		defer file.Close()
-
-		// Read the file content
-		imageBlob, err := ioutil.ReadAll(file)
-		if err != nil {
-			h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
-				"Title":   "Create New Article",
-				"FormURL": "/article/create",
-				"Article": article,
-				"Error":   "Failed to read uploaded image: " + err.Error(),
-			})
-			return
-		}
-
-		// Set the image blob and content type
-		article.ImageBlob = imageBlob
-		article.ImageType = getContentType(header.Filename, header.Header.Get("Content-Type"))
 	}
+	setFormAuthors(r, article)
+	// Empty when no featured image was picked from the library
+	article.FeaturedMediaID, _ = strconv.Atoi(r.FormValue("featured_media_id"))
 
-	// Validate required fields
-	if article.Title == "" || article.Description == "" || article.Author == "" {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
+	// Validate before adding the image, so a rejected form leaves nothing
+	// behind in the media library
+	if err := article.Validate(); err != nil {
+		h.renderInvalidArticle(w, r, map[string]interface{}{
 			"Title":   "Create New Article",
-			"FormURL": "/article/create",
+			"FormURL": h.url("article.create"),
 			"Article": article,
-			"Error":   "Title, Description and Author are required",
-		})
+		}, err, wantsJSON(r))
 		return
 	}
 
-	// Connect to database
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
+	// The image is read, and a remote one copied, before the transaction
+	// since that can take a while
+	media, err := h.featuredImage(r, article)
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
+		status, _ := errorStatus(err)
+		h.renderArticleForm(w, r, status, map[string]interface{}{
 			"Title":   "Create New Article",
-			"FormURL": "/article/create",
+			"FormURL": h.url("article.create"),
 			"Article": article,
-			"Error":   "Failed to connect to database: " + err.Error(),
+			"Error":   errorMessage(r, "Failed to save image", err),
 		})
 		return
 	}
-	defer database.Close()
 
-	// Create article in database
-	id, err := models.CreateArticle(database, article)
+	// Create the article with its image and authors, or nothing at all
+	var id int
+	imageURL, featuredMediaID := article.ImageURL, article.FeaturedMediaID
+	err = models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+		if err := h.saveFeaturedImage(r, tx, article, media); err != nil {
+			return err
+		}
+		if err := resolveAuthors(r.Context(), tx, article); err != nil {
+			return err
+		}
+		var err error
+		if id, err = models.CreateArticle(r.Context(), tx, article); err != nil {
+			return err
+		}
+		created, err := models.GetArticleByID(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		return h.audit(r, tx, "article.create", "article", id, nil, created)
+	})
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
+		// Nothing was saved, so the form keeps the image it was sent with
+		article.ImageURL, article.FeaturedMediaID = imageURL, featuredMediaID
+		status, _ := errorStatus(err)
+		h.renderArticleForm(w, r, status, map[string]interface{}{
 			"Title":   "Create New Article",
-			"FormURL": "/article/create",
+			"FormURL": h.url("article.create"),
 			"Article": article,
-			"Error":   "Failed to create article: " + err.Error(),
+			"Error":   errorMessage(r, "Failed to create article", err),
 		})
 		return
 	}
 
+	// The autosave of the new article form is no longer needed
+	h.discardDraft(r, 0)
+
 	// Redirect to the new article
-	http.Redirect(w, r, "/article?id="+strconv.Itoa(id), http.StatusSeeOther)
+	h.markWrite(w)
+	http.Redirect(w, r, h.url("article", id), http.StatusSeeOther)
 }
 
 // EditArticleHandler displays the form for editing an article
 func (h *Handler) EditArticleHandler(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
-	if idStr == "" {
-		http.Redirect(w, r, "/articles", http.StatusSeeOther)
-		return
-	}
-
-	id, err := strconv.Atoi(idStr)
+	id, err := pathID(r, "article")
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Connect to database
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
+	// Get article to edit from the primary so the form starts from the
+	// latest saved version
+	article, err := models.GetArticleByID(r.Context(), h.cluster.Primary(), id)
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
-			"Title": "Edit Article",
-			"Error": "Failed to connect to database: " + err.Error(),
-		})
+		h.renderError(w, r, err)
 		return
 	}
-	defer database.Close()
 
-	// Get article to edit
-	article, err := models.GetArticleByID(database, id)
-	if err != nil {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
-			"Title": "Edit Article",
-			"Error": "Failed to fetch article: " + err.Error(),
-		})
-		return
-	}
-
-	h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
+	data := map[string]interface{}{
 		"Title":   "Edit Article",
-		"FormURL": "/article/update?id=" + idStr,
+		"FormURL": h.url("article.update", id),
 		"Article": article,
-	})
+	}
+	h.acquireEditLock(r, id, data)
+	h.addAutosave(r, article, data)
+
+	h.renderArticleForm(w, r, http.StatusOK, data)
 }
 
 // UpdateArticleHandler handles updating an existing article
 func (h *Handler) UpdateArticleHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	idStr := r.URL.Query().Get("id")
-	if idStr == "" {
-		http.Error(w, "Article ID is required", http.StatusBadRequest)
-		return
-	}
-
-	id, err := strconv.Atoi(idStr)
+	id, err := pathID(r, "article")
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Parse the multipart form data with 10MB max memory
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+	if !h.parseUploadForm(w, r) {
 		return
 	}
 
@@ -374,141 +467,284 @@ func (h *Handler) UpdateArticleHandler(w http.ResponseWriter, r *http.Request) {
 		Title:       r.FormValue("title"),
 		Description: r.FormValue("description"),
 		ImageURL:    r.FormValue("image_url"),
-		Author:      r.FormValue("author"),
 	}
-
-	// Check if a file was uploaded
-	file, header, err := r.FormFile("image")
-	if err == nil {
-		// File was uploaded
-		defer file.Close()
-
-		// Read the file content
-		imageBlob, err := ioutil.ReadAll(file)
+	setFormAuthors(r, article)
+	// Empty when no featured image was picked from the library
+	article.FeaturedMediaID, _ = strconv.Atoi(r.FormValue("featured_media_id"))
+
+	// The version the editor started from comes from If-Match for API
+	// clients and from the hidden form field for the HTML form
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" {
+		version, ok := parseArticleETag(ifMatch, id)
+		if !ok {
+			h.renderError(w, r, badRequest(http.StatusPreconditionFailed, "If-Match does not match this article"))
+			return
+		}
+		article.Version = version
+	} else {
+		version, err := strconv.Atoi(r.FormValue("version"))
 		if err != nil {
-			h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
-				"Title":   "Edit Article",
-				"FormURL": "/article/update?id=" + idStr,
-				"Article": article,
-				"Error":   "Failed to read uploaded image: " + err.Error(),
-			})
+			h.renderError(w, r, &models.ValidationError{Field: "version", Message: "article version is required"})
 			return
 		}
-
-		// Set the image blob and content type
-		article.ImageBlob = imageBlob
-		article.ImageType = getContentType(header.Filename, header.Header.Get("Content-Type"))
+		article.Version = version
 	}
 
-	// Validate required fields
-	if article.Title == "" || article.Description == "" || article.Author == "" {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
+	if err := article.Validate(); err != nil {
+		h.renderInvalidArticle(w, r, map[string]interface{}{
 			"Title":   "Edit Article",
-			"FormURL": "/article/update?id=" + idStr,
+			"FormURL": h.url("article.update", id),
 			"Article": article,
-			"Error":   "Title, Description and Author are required",
-		})
+		}, err, ifMatch != "" || wantsJSON(r))
 		return
 	}
 
-	// Connect to database
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
+	media, err := h.featuredImage(r, article)
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
+		status, _ := errorStatus(err)
+		h.renderArticleForm(w, r, status, map[string]interface{}{
 			"Title":   "Edit Article",
-			"FormURL": "/article/update?id=" + idStr,
+			"FormURL": h.url("article.update", id),
 			"Article": article,
-			"Error":   "Failed to connect to database: " + err.Error(),
+			"Error":   errorMessage(r, "Failed to save image", err),
 		})
 		return
 	}
-	defer database.Close()
 
-	// Update article in database
-	if err := models.UpdateArticle(database, article); err != nil {
-		h.templates.ExecuteTemplate(w, "article_form.html", map[string]interface{}{
+	// Update the article with its image and authors together, keeping the
+	// stored version, locked so it is the one replaced, for the audit log.
+	// A retried attempt starts again from the version the editor loaded.
+	version := article.Version
+	imageURL, featuredMediaID := article.ImageURL, article.FeaturedMediaID
+	err = models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+		article.Version = version
+		before, err := models.GetArticleForUpdate(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if err := h.saveFeaturedImage(r, tx, article, media); err != nil {
+			return err
+		}
+		if err := resolveAuthors(r.Context(), tx, article); err != nil {
+			return err
+		}
+		if err := models.UpdateArticle(r.Context(), tx, article); err != nil {
+			return err
+		}
+		updated, err := models.GetArticleByID(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		return h.audit(r, tx, "article.update", "article", id, before, updated)
+	})
+	if err != nil {
+		// Nothing was saved, so the form keeps the image it was sent with
+		article.ImageURL, article.FeaturedMediaID = imageURL, featuredMediaID
+	}
+	if errors.Is(err, models.ErrVersionConflict) {
+		h.renderConflict(w, r, article, ifMatch != "")
+		return
+	}
+	if err != nil {
+		status, _ := errorStatus(err)
+		h.renderArticleForm(w, r, status, map[string]interface{}{
 			"Title":   "Edit Article",
-			"FormURL": "/article/update?id=" + idStr,
+			"FormURL": h.url("article.update", id),
 			"Article": article,
-			"Error":   "Failed to update article: " + err.Error(),
+			"Error":   errorMessage(r, "Failed to update article", err),
 		})
 		return
 	}
 
+	h.discardDraft(r, id)
+
+	// The edit is finished, so let others start editing
+	if user := auth.FromContext(r.Context()); !user.Anonymous() {
+		if err := models.ReleaseEditLock(r.Context(), h.cluster.Primary(), id, user.Name); err != nil {
+			log.Printf("Failed to release edit lock on article %d: %v", id, err)
+		}
+	}
+
 	// Redirect to the updated article
-	http.Redirect(w, r, "/article?id="+idStr, http.StatusSeeOther)
+	h.markWrite(w)
+	w.Header().Set("ETag", articleETag(article))
+	http.Redirect(w, r, h.url("article", id), http.StatusSeeOther)
 }
 
-// DeleteArticleHandler handles deleting an article
-func (h *Handler) DeleteArticleHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// renderInvalidArticle responds to an article that failed validation. API
+// clients get the field errors as JSON; the form is shown again with each
+// error next to its input.
+func (h *Handler) renderInvalidArticle(w http.ResponseWriter, r *http.Request, data map[string]interface{}, err error, api bool) {
+	if api {
+		writeJSONError(w, r, err)
 		return
 	}
 
-	idStr := r.FormValue("id")
-	if idStr == "" {
-		http.Error(w, "Article ID is required", http.StatusBadRequest)
-		return
+	fields := fieldErrors(err)
+	for field, message := range fields {
+		fields[field] = capitalize(message)
+	}
+	data["Error"] = "Please correct the errors below"
+	data["FieldErrors"] = fields
+
+	h.renderArticleForm(w, r, http.StatusUnprocessableEntity, data)
+}
+
+// renderArticleForm responds with status and the article form, offering the
+// known authors as suggestions for the author inputs
+func (h *Handler) renderArticleForm(w http.ResponseWriter, r *http.Request, status int, data map[string]interface{}) {
+	if _, ok := data["FieldErrors"]; !ok {
+		data["FieldErrors"] = map[string]string{}
+	}
+
+	authors, err := models.GetAuthors(r.Context(), h.cluster.Primary())
+	if err != nil {
+		log.Printf("Failed to fetch authors: %v", err)
+	}
+	data["KnownAuthors"] = authors
+
+	// Show the picked featured image again when the form is re-rendered
+	if article, ok := data["Article"].(*models.Article); ok && article.FeaturedMediaID != 0 && article.FeaturedMedia == nil {
+		article.FeaturedMedia, err = models.GetMediaByID(r.Context(), h.cluster.Primary(), article.FeaturedMediaID)
+		if err != nil {
+			log.Printf("Failed to fetch featured image %d: %v", article.FeaturedMediaID, err)
+		}
+	}
+
+	// Warn about a hot-linked image that stopped working
+	if article, ok := data["Article"].(*models.Article); ok && article.ImageURL != "" {
+		check, err := models.GetImageCheck(r.Context(), h.cluster.Primary(), article.ImageURL)
+		if err != nil {
+			log.Printf("Failed to fetch image check for %s: %v", article.ImageURL, err)
+		}
+		data["ImageCheck"] = check
+	}
+
+	h.renderStatus(w, r, status, "article_form.html", data)
+}
+
+// setFormAuthors fills in the article's authors from the repeated author
+// form fields. The authors only carry names until resolveAuthors runs.
+func setFormAuthors(r *http.Request, article *models.Article) {
+	var names []string
+	for _, name := range r.Form["author"] {
+		if name = models.NormalizeAuthorName(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	article.Authors = make([]models.Author, len(names))
+	for i, name := range names {
+		article.Authors[i] = models.Author{Name: name}
 	}
+	article.Author = models.Byline(names)
+}
 
-	id, err := strconv.Atoi(idStr)
+// resolveAuthors links the article's authors to author records, creating
+// records for new names, and rebuilds the byline from their canonical names
+func resolveAuthors(ctx context.Context, db models.DBTX, article *models.Article) error {
+	authors, err := models.FindOrCreateAuthors(ctx, db, article.AuthorNames())
 	if err != nil {
-		http.Error(w, "Invalid article ID", http.StatusBadRequest)
+		return err
+	}
+
+	article.Authors = authors
+	article.Author = models.Byline(article.AuthorNames())
+	return nil
+}
+
+// renderConflict responds to an update that lost the race against another
+// editor. API clients get 412 with the current article; the HTML form gets a
+// page showing both versions with a form to merge them.
+func (h *Handler) renderConflict(w http.ResponseWriter, r *http.Request, mine *models.Article, api bool) {
+	theirs, err := models.GetArticleByID(r.Context(), h.cluster.Primary(), mine.ID)
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Connect to database
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
+	if mine.FeaturedMediaID != 0 {
+		mine.FeaturedMedia, err = models.GetMediaByID(r.Context(), h.cluster.Primary(), mine.FeaturedMediaID)
+		if err != nil {
+			log.Printf("Failed to fetch featured image %d: %v", mine.FeaturedMediaID, err)
+		}
+	}
+
+	if api {
+		w.Header().Set("ETag", articleETag(theirs))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"message": models.ErrVersionConflict.Error(),
+			"article": theirs,
+		})
+		return
+	}
+
+	h.renderStatus(w, r, http.StatusConflict, "article_conflict.html", map[string]interface{}{
+		"Title":   "Edit Conflict",
+		"FormURL": h.url("article.update", mine.ID),
+		"Mine":    mine,
+		"Theirs":  theirs,
+	})
+}
+
+// articleETag returns the entity tag identifying a version of an article
+func articleETag(article *models.Article) string {
+	return fmt.Sprintf(`"article-%d-v%d"`, article.ID, article.Version)
+}
+
+// parseArticleETag extracts the version from an If-Match value produced by
+// articleETag for the article with the given ID
+func parseArticleETag(value string, id int) (int, bool) {
+	prefix := fmt.Sprintf(`"article-%d-v`, id)
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, prefix) || !strings.HasSuffix(value, `"`) {
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(value[len(prefix) : len(value)-1])
 	if err != nil {
-		http.Error(w, "Failed to connect to database: "+err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return version, true
+}
+
+// DeleteArticleHandler handles deleting an article
+func (h *Handler) DeleteArticleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "article")
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
-	defer database.Close()
 
-	// Delete article from database
-	if err := models.DeleteArticle(database, id); err != nil {
-		http.Error(w, "Failed to delete article: "+err.Error(), http.StatusInternalServerError)
+	// Delete the article with its autosaves, which can never be restored,
+	// keeping what it was for the audit log
+	err = models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+		before, err := models.GetArticleForUpdate(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if err := models.DeleteArticle(r.Context(), tx, id); err != nil {
+			return err
+		}
+		if err := models.DeleteArticleDrafts(r.Context(), tx, id); err != nil {
+			return err
+		}
+		return h.audit(r, tx, "article.delete", "article", id, before, nil)
+	})
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
 	// Return JSON response for AJAX requests
+	h.markWrite(w)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"message": "Article deleted successfully",
 	})
 }
-
-// getContentType determines the content type from filename and provided content type
-func getContentType(filename, providedType string) string {
-	if providedType != "" && providedType != "application/octet-stream" {
-		return providedType
-	}
-
-	// Try to detect from extension
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	case ".gif":
-		return "image/gif"
-	case ".webp":
-		return "image/webp"
-	case ".svg":
-		return "image/svg+xml"
-	default:
-		// Try to guess from extension using MIME package
-		mimeType := mime.TypeByExtension(ext)
-		if mimeType != "" {
-			return mimeType
-		}
-	}
-
-	// Default to generic binary
-	return "application/octet-stream"
-}
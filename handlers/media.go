@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/farrell_ivander/test-conn/auth"
+	"github.com/farrell_ivander/test-conn/models"
+	"github.com/farrell_ivander/test-conn/remote"
+)
+
+// mediaPageSize caps the number of assets listed in the library and picker
+const mediaPageSize = 100
+
+// uploadFormOverhead allows for the text fields sent along with an image
+// in the same form
+const uploadFormOverhead = 1 << 20
+
+// parseUploadForm parses a multipart form that may carry an image upload,
+// refusing request bodies larger than the upload limit allows. On failure
+// it writes the error response and returns false.
+func (h *Handler) parseUploadForm(w http.ResponseWriter, r *http.Request) bool {
+	maxBytes := h.config.Media.UploadMaxBytes
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes)+uploadFormOverhead)
+
+	// Parse the multipart form data with 10MB max memory
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			err = badRequest(http.StatusRequestEntityTooLarge, fmt.Sprintf("upload too large: images are limited to %d KB", maxBytes>>10))
+		} else {
+			err = formError(err)
+		}
+		h.renderError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// mediaDetails reads the alt text, caption and credit of a new asset from
+// the form fields named after prefix with _alt, _caption and _credit appended
+func mediaDetails(r *http.Request, prefix string) *models.Media {
+	return &models.Media{
+		AltText:    strings.TrimSpace(r.FormValue(prefix + "_alt")),
+		Caption:    strings.TrimSpace(r.FormValue(prefix + "_caption")),
+		Credit:     strings.TrimSpace(r.FormValue(prefix + "_credit")),
+		UploadedBy: auth.FromContext(r.Context()).Name,
+	}
+}
+
+// uploadedMedia reads the file uploaded in the given form field for the
+// media library, with details read by mediaDetails. It returns nil if no
+// file was uploaded. The asset is added by saveMedia.
+func (h *Handler) uploadedMedia(r *http.Request, field string) (*models.Media, error) {
+	file, header, err := r.FormFile(field)
+	if err == http.ErrMissingFile {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Read one byte more than allowed so CheckImage sees oversized files
+	maxBytes := h.config.Media.UploadMaxBytes
+	data, err := io.ReadAll(io.LimitReader(file, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	// Neither the file name nor the type claimed by the browser is trusted
+	contentType, err := models.CheckImage(data, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	media := mediaDetails(r, field)
+	media.FileName = models.ImageFileName(header.Filename, contentType)
+	media.ContentType = contentType
+	media.Data = data
+	return media, nil
+}
+
+// fetchedMedia copies the image at rawURL for the media library, with
+// details read by mediaDetails using prefix. The asset is added by
+// saveMedia.
+func (h *Handler) fetchedMedia(r *http.Request, rawURL, prefix string) (*models.Media, error) {
+	image, err := h.fetcher.Fetch(r.Context(), rawURL)
+	if err != nil {
+		log.Printf("Failed to copy image from %s: %v", rawURL, err)
+		return nil, &models.ValidationError{Field: prefix, Message: fetchErrorMessage(rawURL, err)}
+	}
+
+	media := mediaDetails(r, prefix)
+	media.FileName = image.FileName
+	media.ContentType = image.ContentType
+	media.Data = image.Data
+	media.SourceURL = rawURL
+	return media, nil
+}
+
+// fetchErrorMessage describes a failure to copy the image at rawURL to the
+// editor. Only the reasons that concern the image are given: connection
+// errors can name hosts and addresses inside our network.
+func fetchErrorMessage(rawURL string, err error) string {
+	message := "could not copy the image from " + rawURL
+	switch {
+	case errors.Is(err, remote.ErrBlockedAddress):
+		return message + ": " + remote.ErrBlockedAddress.Error()
+	case errors.Is(err, remote.ErrTooLarge), errors.Is(err, models.ErrUnsupportedImage), errors.Is(err, models.ErrImageTooLarge):
+		return message + ": " + err.Error()
+	}
+	return message
+}
+
+// saveMedia adds media to the library and records it in the audit log,
+// in db, which should be a transaction
+func (h *Handler) saveMedia(r *http.Request, db models.DBTX, media *models.Media) error {
+	if _, err := models.CreateMedia(r.Context(), db, media); err != nil {
+		return err
+	}
+	created, err := models.GetMediaByID(r.Context(), db, media.ID)
+	if err != nil {
+		return err
+	}
+	return h.audit(r, db, "media.create", "media", media.ID, nil, created)
+}
+
+// featuredImage reads the image uploaded with the article form. Without an
+// upload, a remote image URL is copied instead of hot-linked when the
+// editor asked for it. It returns nil when there is neither; the image is
+// added by saveFeaturedImage in the article's transaction.
+func (h *Handler) featuredImage(r *http.Request, article *models.Article) (*models.Media, error) {
+	media, err := h.uploadedMedia(r, "image")
+	if err != nil || media != nil {
+		return media, err
+	}
+
+	if article.ImageURL != "" && r.FormValue("fetch_image") != "" {
+		return h.fetchedMedia(r, article.ImageURL, "image")
+	}
+	return nil, nil
+}
+
+// saveFeaturedImage adds media, if any, to the media library in db and
+// makes it the featured image of article, in place of the remote URL it
+// was copied from
+func (h *Handler) saveFeaturedImage(r *http.Request, db models.DBTX, article *models.Article, media *models.Media) error {
+	if media == nil {
+		return nil
+	}
+	if err := h.saveMedia(r, db, media); err != nil {
+		return err
+	}
+
+	article.FeaturedMediaID = media.ID
+	if media.SourceURL != "" {
+		article.ImageURL = ""
+	}
+	return nil
+}
+
+// MediaLibraryHandler lists and searches the media library. With
+// format=json it returns the assets for the article form's image picker.
+func (h *Handler) MediaLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	searchTerm := strings.TrimSpace(r.URL.Query().Get("search"))
+
+	media, err := models.SearchMedia(r.Context(), h.reader(r), searchTerm, mediaPageSize)
+
+	if r.URL.Query().Get("format") == "json" {
+		if err != nil {
+			h.renderError(w, r, err)
+			return
+		}
+		if media == nil {
+			media = []models.Media{}
+		}
+
+		type pickerItem struct {
+			models.Media
+			URL       string `json:"url"`
+			Shortcode string `json:"shortcode"`
+		}
+		items := make([]pickerItem, len(media))
+		for i := range media {
+			items[i] = pickerItem{media[i], media[i].URL(), models.MediaShortcode(media[i].ID)}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+		return
+	}
+
+	data := map[string]interface{}{
+		"SearchTerm": searchTerm,
+		"Media":      media,
+		"Uploaded":   r.URL.Query().Get("uploaded"),
+	}
+	if err != nil {
+		data["Error"] = errorMessage(r, "Failed to fetch media", err)
+	}
+
+	h.render(w, r, "media.html", data)
+}
+
+// MediaUploadHandler adds an uploaded image to the media library
+func (h *Handler) MediaUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.parseUploadForm(w, r) {
+		return
+	}
+
+	media, err := h.uploadedMedia(r, "file")
+	if err == nil && media == nil {
+		err = badRequest(http.StatusBadRequest, "choose an image to upload")
+	}
+	if err == nil {
+		err = models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+			return h.saveMedia(r, tx, media)
+		})
+	}
+	if err != nil {
+		status, _ := errorStatus(err)
+		h.renderMediaError(w, r, status, errorMessage(r, "Failed to upload image", err))
+		return
+	}
+
+	h.markWrite(w)
+	http.Redirect(w, r, h.url("media")+"?uploaded="+strconv.Itoa(media.ID), http.StatusSeeOther)
+}
+
+// MediaFetchHandler copies an image from a remote URL into the media library
+func (h *Handler) MediaFetchHandler(w http.ResponseWriter, r *http.Request) {
+	rawURL := strings.TrimSpace(r.FormValue("url"))
+	if rawURL == "" {
+		h.renderMediaError(w, r, http.StatusBadRequest, "Image URL is required")
+		return
+	}
+
+	media, err := h.fetchedMedia(r, rawURL, "url")
+	if err == nil {
+		err = models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+			return h.saveMedia(r, tx, media)
+		})
+	}
+	if err != nil {
+		status, _ := errorStatus(err)
+		h.renderMediaError(w, r, status, errorMessage(r, "Failed to add image", err))
+		return
+	}
+
+	h.markWrite(w)
+	http.Redirect(w, r, h.url("media")+"?uploaded="+strconv.Itoa(media.ID), http.StatusSeeOther)
+}
+
+// renderMediaError responds with status and the media library, with
+// message shown above it in place of the upload that failed
+func (h *Handler) renderMediaError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	data := map[string]interface{}{
+		"Error": message,
+	}
+	if media, err := models.SearchMedia(r.Context(), h.reader(r), "", mediaPageSize); err == nil {
+		data["Media"] = media
+	} else {
+		logError(r, err)
+	}
+
+	h.renderStatus(w, r, status, "media.html", data)
+}
+
+// EditMediaHandler displays the alt text, caption and credit of an asset
+func (h *Handler) EditMediaHandler(w http.ResponseWriter, r *http.Request) {
+	media, ok := h.editableMedia(w, r)
+	if !ok {
+		return
+	}
+
+	h.render(w, r, "media_form.html", map[string]interface{}{
+		"Media": media,
+	})
+}
+
+// UpdateMediaHandler saves the alt text, caption and credit of an asset
+func (h *Handler) UpdateMediaHandler(w http.ResponseWriter, r *http.Request) {
+	media, ok := h.editableMedia(w, r)
+	if !ok {
+		return
+	}
+	before := *media
+
+	media.AltText = strings.TrimSpace(r.FormValue("alt_text"))
+	media.Caption = strings.TrimSpace(r.FormValue("caption"))
+	media.Credit = strings.TrimSpace(r.FormValue("credit"))
+
+	err := models.WithTx(r.Context(), h.cluster.Primary(), func(tx models.DBTX) error {
+		if err := models.UpdateMedia(r.Context(), tx, media); err != nil {
+			return err
+		}
+		updated, err := models.GetMediaByID(r.Context(), tx, media.ID)
+		if err != nil {
+			return err
+		}
+		return h.audit(r, tx, "media.update", "media", media.ID, before, updated)
+	})
+	if err != nil {
+		h.render(w, r, "media_form.html", map[string]interface{}{
+			"Media": media,
+			"Error": errorMessage(r, "Failed to update media", err),
+		})
+		return
+	}
+
+	h.markWrite(w)
+	http.Redirect(w, r, h.url("media"), http.StatusSeeOther)
+}
+
+// editableMedia fetches the asset in the path from the primary for the
+// media form. On failure it writes the response and returns false.
+func (h *Handler) editableMedia(w http.ResponseWriter, r *http.Request) (*models.Media, bool) {
+	id, err := pathID(r, "media")
+	if err != nil {
+		h.renderError(w, r, err)
+		return nil, false
+	}
+
+	media, err := models.GetMediaByID(r.Context(), h.cluster.Primary(), id)
+	if err != nil {
+		h.renderError(w, r, err)
+		return nil, false
+	}
+
+	return media, true
+}
+
+// MediaFileHandler serves the image of a library asset
+func (h *Handler) MediaFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "media")
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	data, _, err := models.GetMediaData(r.Context(), h.reader(r), id)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	// Asset data never changes once uploaded, so browsers can keep it
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	writeImage(w, data, "media-"+strconv.Itoa(id))
+}
+
+// writeImage writes stored image data with headers that keep browsers from
+// treating it as anything but an image. The type is detected from the data
+// rather than trusted from the database; data that isn't an accepted image,
+// such as SVG uploaded before uploads were checked, is sent as a download.
+func writeImage(w http.ResponseWriter, data []byte, name string) {
+	disposition := "inline"
+	contentType, err := models.DetectImageType(data)
+	if err != nil {
+		disposition = "attachment"
+		contentType = "application/octet-stream"
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": models.ImageFileName(name, contentType),
+	}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Even if opened directly, the response can't run scripts or load anything
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Write(data)
+}
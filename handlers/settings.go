@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/farrell_ivander/test-conn/auth"
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+// SettingsHandler displays the site settings form
+func (h *Handler) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	h.render(w, r, "settings.html", map[string]interface{}{
+		"Settings":       h.settings.Get(r.Context()),
+		"SocialNetworks": models.SocialNetworks,
+		"FieldErrors":    map[string]string{},
+		"Saved":          r.URL.Query().Get("saved") != "",
+	})
+}
+
+// UpdateSettingsHandler saves the site settings form and records the
+// change in the audit log
+func (h *Handler) UpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderError(w, r, formError(err))
+		return
+	}
+
+	// An unparseable page size is left at 0 for validation to report
+	pageSize, _ := strconv.Atoi(strings.TrimSpace(r.FormValue("page_size")))
+	settings := &models.Settings{
+		SiteName:    r.FormValue("site_name"),
+		Tagline:     r.FormValue("tagline"),
+		PageSize:    pageSize,
+		TimeZone:    strings.TrimSpace(r.FormValue("time_zone")),
+		SocialLinks: make(map[string]string),
+	}
+	for _, network := range models.SocialNetworks {
+		if link := strings.TrimSpace(r.FormValue("social_" + network)); link != "" {
+			settings.SocialLinks[network] = link
+		}
+	}
+
+	err := h.settings.Update(r.Context(), settings, auth.FromContext(r.Context()).Name, func(tx models.DBTX, before *models.Settings) error {
+		return h.audit(r, tx, "settings.update", "settings", "", before, settings)
+	})
+	if err != nil {
+		data := map[string]interface{}{
+			"Settings":       settings,
+			"SocialNetworks": models.SocialNetworks,
+			"FieldErrors":    map[string]string{},
+		}
+		if fields := fieldErrors(err); fields != nil {
+			for field, message := range fields {
+				fields[field] = capitalize(message)
+			}
+			data["FieldErrors"] = fields
+			data["Error"] = "Please correct the errors below"
+		} else {
+			data["Error"] = errorMessage(r, "Failed to save settings", err)
+		}
+
+		status, _ := errorStatus(err)
+		h.renderStatus(w, r, status, "settings.html", data)
+		return
+	}
+
+	http.Redirect(w, r, h.url("admin.settings")+"?saved=1", http.StatusSeeOther)
+}
@@ -1,64 +1,323 @@
 package main
 
 import (
+	"context"
+	"embed"
+	"errors"
 	"flag"
+	"fmt"
+	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	_ "time/tzdata" // The time zone setting must work in images without zoneinfo
 
-	"github.com/joho/godotenv"
-
+	"github.com/farrell_ivander/test-conn/auth"
+	"github.com/farrell_ivander/test-conn/config"
 	"github.com/farrell_ivander/test-conn/db"
 	"github.com/farrell_ivander/test-conn/handlers"
+	"github.com/farrell_ivander/test-conn/models"
+	"github.com/farrell_ivander/test-conn/ratelimit"
+	"github.com/farrell_ivander/test-conn/remote"
+	"github.com/farrell_ivander/test-conn/router"
+	"github.com/farrell_ivander/test-conn/security"
+	"github.com/farrell_ivander/test-conn/settings"
+	"github.com/farrell_ivander/test-conn/views"
 )
 
+// assets holds the built-in theme: the templates, static files and theme
+// manifest, so the binary runs from any directory
+//
+//go:embed templates static theme.json
+var assets embed.FS
+
 func main() {
-	// Load environment variables from .env file
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using environment variables")
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(runConfigCommand(args[1:]))
+	}
+
+	cfg, rest, err := config.Load(os.Args[0], args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if len(rest) > 0 {
+		log.Fatalf("Unknown command %q", rest[0])
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	// In dev mode templates and static files are read from the working
+	// directory, so edits show up without rebuilding. A theme directory
+	// replaces any of them.
+	var files fs.FS = assets
+	if cfg.Server.DevMode {
+		files = os.DirFS(".")
+	}
+	if cfg.Server.ThemeDir != "" {
+		files = views.Overlay(os.DirFS(cfg.Server.ThemeDir), files)
+	}
+
+	// Static files are linked by fingerprinted names so browsers can cache
+	// them for good, except in dev mode
+	staticFiles, err := fs.Sub(files, "static")
+	if err != nil {
+		log.Fatalf("Failed to open static files: %v", err)
+	}
+	static, err := views.NewAssets(staticFiles, "/static/", !cfg.Server.DevMode)
+	if err != nil {
+		log.Fatalf("Failed to fingerprint static files: %v", err)
 	}
 
-	// Parse command line flags
-	port := flag.String("port", "8080", "Port to run the server on")
-	flag.Parse()
+	// Load the templates and theme before connecting so mistakes in them
+	// stop the server right away. Pages build links from the named routes
+	// of rt.
+	rt := router.New()
+	pages, err := views.New(files, template.FuncMap{"url": rt.URL, "asset": static.Path}, cfg.Server.DevMode)
+	if err != nil {
+		log.Fatalf("Failed to load templates: %v", err)
+	}
 
-	// Initialize database connection
-	dbConn := db.NewConnectionFromEnv()
-	database, err := dbConn.GetDB()
+	// Cancel the root context on SIGINT/SIGTERM so the server and any
+	// background workers can shut down cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Initialize database connections to the primary and any read replicas
+	dbConn := cfg.Database.Connection()
+	cluster, err := db.OpenCluster(ctx, dbConn)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	// Queries stop when their request does, or after the query timeout
+	models.SetQueryTimeout(cfg.Database.QueryTimeout)
+
 	// Run database migrations
-	if err := db.RunMigrations(database); err != nil {
+	if err := db.RunMigrations(ctx, cluster.Primary()); err != nil {
+		cluster.Close()
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
-	database.Close()
+	// Remote images are fetched through a single SSRF-safe client
+	fetcher := remote.NewFetcher(cfg.Media)
+
+	// Site settings are cached and dates on pages follow their time zone
+	site := settings.New(cluster.Primary())
+	site.OnChange(func(s *models.Settings) {
+		pages.SetLocation(s.Location())
+	})
+	site.Get(ctx)
+
+	// Initialize the handlers. They build links from the named routes
+	// registered on rt below.
+	h := handlers.NewHandler(cfg, cluster, fetcher, rt, pages, site)
+	authn, err := auth.New(cfg.Auth)
+	if err != nil {
+		cluster.Close()
+		log.Fatalf("Invalid auth settings: %v", err)
+	}
+	proxies, err := cfg.Auth.TrustedProxyPrefixes()
+	if err != nil {
+		cluster.Close()
+		log.Fatalf("Invalid auth settings: %v", err)
+	}
+	headers := security.New(cfg.Security, proxies)
+
+	// Rate limit buckets are shared through the database when several
+	// instances serve the site
+	var buckets ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == "mysql" {
+		buckets = ratelimit.NewMySQLStore(cluster.Primary())
+	}
+	limiter := ratelimit.New(buckets, cfg.RateLimit, proxies)
+
+	// Background workers register with this group and must return once ctx
+	// is cancelled
+	var workers sync.WaitGroup
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		cluster.MonitorReplicas(ctx, cfg.Database.ReplicaHealthInterval)
+	}()
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		fetcher.MonitorImages(ctx, cluster.Primary(), cfg.Media.RecheckInterval)
+	}()
 
-	// Initialize the handlers
-	h := handlers.NewHandler()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		limiter.PruneBuckets(ctx, 10*time.Minute)
+	}()
 
-	// Define routes
-	http.HandleFunc("/", h.HomeHandler)
-	http.HandleFunc("/test-connection", h.TestConnectionHandler)
-	http.HandleFunc("/articles", h.ListArticlesHandler)
-	http.HandleFunc("/article", h.GetArticleHandler)
-	http.HandleFunc("/image", h.GetImageHandler) // Add image serving handler
+	// Define routes. Rate limits apply per user, or per IP address for
+	// anonymous clients; images, static files and the editor's background
+	// requests are not limited.
+	reads := rt.Group("", limiter.Limits(ratelimit.Read))
+	writes := rt.Group("", limiter.Limits(ratelimit.Write))
 
-	// Article management routes
-	http.HandleFunc("/article/new", h.NewArticleHandler)
-	http.HandleFunc("/article/create", h.CreateArticleHandler)
-	http.HandleFunc("/article/edit", h.EditArticleHandler)
-	http.HandleFunc("/article/update", h.UpdateArticleHandler)
-	http.HandleFunc("/article/delete", h.DeleteArticleHandler)
+	rt.Get("/{$}", "home", h.HomeHandler)
+	rt.Group("", limiter.Limits(ratelimit.TestConnection), auth.Requires(auth.RoleAdmin)).
+		Post("/test-connection", "test-connection", h.TestConnectionHandler)
+
+	// Article routes; articles are public, writing them is for reporters
+	reads.Get("/articles", "articles", h.ListArticlesHandler)
+	reads.Get("/articles/{id}", "article", h.GetArticleHandler)
+	rt.Get("/articles/{id}/image", "article.image", h.GetImageHandler)
+	reporters := rt.Group("", auth.Requires(auth.RoleReporter))
+	reporters.Get("/articles/new", "article.new", h.NewArticleHandler)
+	reporters.Get("/articles/{id}/edit", "article.edit", h.EditArticleHandler)
+	reporterWrites := writes.Group("", auth.Requires(auth.RoleReporter))
+	reporterWrites.Post("/articles", "article.create", h.CreateArticleHandler)
+	reporterWrites.Post("/articles/{id}", "article.update", h.UpdateArticleHandler)
+	reporterWrites.Delete("/articles/{id}", "article.delete", h.DeleteArticleHandler)
+
+	// Autosave and edit lock routes, used by the article form. The new
+	// article form autosaves as article 0.
+	editing := rt.Group("/articles/{id}", auth.Requires(auth.RoleReporter))
+	editing.Get("/autosave", "article.autosave", h.GetAutosaveHandler)
+	editing.Post("/autosave", "article.autosave.save", h.SaveAutosaveHandler)
+	editing.Post("/autosave/discard", "article.autosave.discard", h.DiscardAutosaveHandler)
+	editing.Post("/lock/heartbeat", "article.lock.heartbeat", h.LockHeartbeatHandler)
+	editing.Post("/lock/release", "article.lock.release", h.LockReleaseHandler)
+	rt.Group("/articles/{id}", auth.Requires(auth.RoleEditor)).
+		Post("/lock/takeover", "article.lock.takeover", h.LockTakeOverHandler)
+
+	// Author routes; profiles are public, managing them is for editors
+	reads.Get("/authors", "authors", h.ListAuthorsHandler)
+	reads.Get("/authors/{slug}", "author", h.AuthorHandler)
+	editors := rt.Group("", auth.Requires(auth.RoleEditor))
+	editors.Get("/authors/new", "author.new", h.NewAuthorHandler)
+	editors.Get("/authors/{slug}/edit", "author.edit", h.EditAuthorHandler)
+	editorWrites := writes.Group("", auth.Requires(auth.RoleEditor))
+	editorWrites.Post("/authors", "author.create", h.CreateAuthorHandler)
+	editorWrites.Post("/authors/{slug}", "author.update", h.UpdateAuthorHandler)
+	editorWrites.Post("/authors/{slug}/merge", "author.merge", h.MergeAuthorHandler)
+
+	// Media library routes
+	reads.Get("/media", "media", h.MediaLibraryHandler)
+	rt.Get("/media/{id}", "media.file", h.MediaFileHandler)
+	reads.Group("", auth.Requires(auth.RoleReporter)).
+		Get("/media/{id}/edit", "media.edit", h.EditMediaHandler)
+	reporterWrites.Post("/media", "media.upload", h.MediaUploadHandler)
+	reporterWrites.Post("/media/fetch", "media.fetch", h.MediaFetchHandler)
+	reporterWrites.Post("/media/{id}", "media.update", h.UpdateMediaHandler)
+
+	// Admin routes
+	adminReads := reads.Group("/admin", auth.Requires(auth.RoleAdmin))
+	adminReads.Get("/settings", "admin.settings", h.SettingsHandler)
+	adminReads.Get("/audit", "admin.audit", h.AuditLogHandler)
+	writes.Group("/admin", auth.Requires(auth.RoleAdmin)).
+		Post("/settings", "admin.settings.update", h.UpdateSettingsHandler)
+
+	// Unknown paths get the same error page as missing records
+	rt.NotFound(h.NotFoundHandler)
+
+	// Links to the query string URLs used before routes had path
+	// parameters keep working
+	rt.Get("/article", "", h.LegacyRedirect("article", "id"))
+	rt.Get("/image", "", h.LegacyRedirect("article.image", "id"))
+	rt.Get("/author/{slug}", "", h.LegacyRedirect("author", "slug"))
+	rt.Get("/media/file", "", h.LegacyRedirect("media.file", "id"))
+
+	// Browsers report Content Security Policy violations here
+	reads.Post(security.ReportPath, "", security.ReportHandler)
 
 	// Serve static files
-	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	rt.Mount("/static/", http.StripPrefix("/static/", static))
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.Server.Port,
+		Handler:           headers.Middleware(authn.Middleware(rt)),
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
 
 	// Start the server
-	log.Printf("Server starting on port %s...\n", *port)
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on port %s...\n", cfg.Server.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+		close(serverErr)
+	}()
+
+	select {
+	case err := <-serverErr:
+		stop()
+		workers.Wait()
+		cluster.Close()
 		log.Fatalf("Error starting server: %v", err)
+	case <-ctx.Done():
+	}
+
+	// Stop receiving signals so a second SIGINT kills the process immediately
+	stop()
+	log.Println("Shutting down server...")
+
+	// Drain in-flight requests, then stop background work and release the
+	// database pools
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error during server shutdown: %v", err)
+	}
+
+	workers.Wait()
+
+	if err := cluster.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+
+	log.Println("Server stopped")
+}
+
+// runConfigCommand implements the "config" subcommand and returns the exit code
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: news-cms config print [flags]")
+		return 2
 	}
+
+	cfg, rest, err := config.Load("config print", args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument %q\n", rest[0])
+		return 2
+	}
+
+	if err := cfg.Print(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print configuration: %v\n", err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nConfiguration is invalid:\n%v\n", err)
+		return 1
+	}
+
+	return 0
 }
@@ -1,28 +1,41 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"time"
 )
 
+// ErrVersionConflict is returned by UpdateArticle when the article was
+// changed by someone else since the editor loaded it
+var ErrVersionConflict error = &ConflictError{Message: "article was modified by someone else"}
+
 // Article represents a news article
 type Article struct {
 	ID          int       `json:"id"`
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	ImageURL    string    `json:"image_url"`
-	Author      string    `json:"author"`
+	Author      string    `json:"author"` // Byline derived from Authors
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
-	ImageBlob   []byte    `json:"-"` // Binary image data
-	ImageType   string    `json:"-"` // MIME type of the image
-	HasImage    bool      `json:"has_image"`
+	ImageType   string    `json:"-"`         // MIME type of the legacy inline image
+	HasImage    bool      `json:"has_image"` // A legacy inline image is stored with the article
+	Version     int       `json:"version"`   // Incremented on every update
+	Authors     []Author  `json:"authors"`   // Credited authors in byline order
+
+	FeaturedMediaID int            `json:"featured_media_id"` // 0 for no featured image
+	FeaturedMedia   *Media         `json:"featured_media,omitempty"`
+	InlineMedia     map[int]*Media `json:"-"` // Assets embedded in the body, by ID
 }
 
 // GetArticles fetches articles from the database with optional limit
-func GetArticles(db *sql.DB, limit int) ([]Article, error) {
+func GetArticles(ctx context.Context, db DBTX, limit int) ([]Article, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	query := `
-		SELECT id, title, description, image_url, author, created_at, updated_at,
+		SELECT id, title, description, image_url, author, created_at, updated_at, version, featured_media_id,
 		       CASE WHEN image_data IS NOT NULL THEN true ELSE false END as has_image
 		FROM articles ORDER BY created_at DESC
 	`
@@ -34,9 +47,9 @@ func GetArticles(db *sql.DB, limit int) ([]Article, error) {
 	var err error
 
 	if limit > 0 {
-		rows, err = db.Query(query, limit)
+		rows, err = db.QueryContext(ctx, query, limit)
 	} else {
-		rows, err = db.Query(query)
+		rows, err = db.QueryContext(ctx, query)
 	}
 
 	if err != nil {
@@ -48,6 +61,7 @@ func GetArticles(db *sql.DB, limit int) ([]Article, error) {
 
 	for rows.Next() {
 		var article Article
+		var featuredMediaID sql.NullInt64
 		err := rows.Scan(
 			&article.ID,
 			&article.Title,
@@ -56,11 +70,14 @@ func GetArticles(db *sql.DB, limit int) ([]Article, error) {
 			&article.Author,
 			&article.CreatedAt,
 			&article.UpdatedAt,
+			&article.Version,
+			&featuredMediaID,
 			&article.HasImage,
 		)
 		if err != nil {
 			return nil, err
 		}
+		article.FeaturedMediaID = int(featuredMediaID.Int64)
 		articles = append(articles, article)
 	}
 
@@ -68,19 +85,39 @@ func GetArticles(db *sql.DB, limit int) ([]Article, error) {
 		return nil, err
 	}
 
+	if err := loadListDetails(ctx, db, articles); err != nil {
+		return nil, err
+	}
+
 	return articles, nil
 }
 
 // GetArticleByID fetches a single article by ID
-func GetArticleByID(db *sql.DB, id int) (*Article, error) {
+func GetArticleByID(ctx context.Context, db DBTX, id int) (*Article, error) {
+	return getArticle(ctx, db, id, "")
+}
+
+// GetArticleForUpdate fetches a single article by ID and locks it until
+// the transaction db ends, so it is what a change made in db replaces
+func GetArticleForUpdate(ctx context.Context, db DBTX, id int) (*Article, error) {
+	return getArticle(ctx, db, id, " FOR UPDATE")
+}
+
+// getArticle fetches a single article by ID, with lock appended to the
+// query for its row
+func getArticle(ctx context.Context, db DBTX, id int, lock string) (*Article, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	query := `
-		SELECT id, title, description, image_url, author, created_at, updated_at, 
+		SELECT id, title, description, image_url, author, created_at, updated_at, version, featured_media_id,
 		       image_type, CASE WHEN image_data IS NOT NULL THEN true ELSE false END as has_image
-		FROM articles WHERE id = ?
-	`
+		FROM articles WHERE id = ?` + lock
 
 	var article Article
-	err := db.QueryRow(query, id).Scan(
+	var featuredMediaID sql.NullInt64
+	var imageType sql.NullString
+	err := db.QueryRowContext(ctx, query, id).Scan(
 		&article.ID,
 		&article.Title,
 		&article.Description,
@@ -88,10 +125,22 @@ func GetArticleByID(db *sql.DB, id int) (*Article, error) {
 		&article.Author,
 		&article.CreatedAt,
 		&article.UpdatedAt,
-		&article.ImageType,
+		&article.Version,
+		&featuredMediaID,
+		&imageType,
 		&article.HasImage,
 	)
 	if err != nil {
+		return nil, notFound(err, "article", id)
+	}
+	article.FeaturedMediaID = int(featuredMediaID.Int64)
+	article.ImageType = imageType.String
+
+	if err := loadArticleAuthors(ctx, db, []*Article{&article}); err != nil {
+		return nil, err
+	}
+
+	if err := loadArticleMedia(ctx, db, []*Article{&article}, true); err != nil {
 		return nil, err
 	}
 
@@ -99,9 +148,12 @@ func GetArticleByID(db *sql.DB, id int) (*Article, error) {
 }
 
 // SearchArticles searches for articles matching the given term
-func SearchArticles(db *sql.DB, term string) ([]Article, error) {
+func SearchArticles(ctx context.Context, db DBTX, term string) ([]Article, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	query := `
-		SELECT id, title, description, image_url, author, created_at, updated_at,
+		SELECT id, title, description, image_url, author, created_at, updated_at, version, featured_media_id,
 		       CASE WHEN image_data IS NOT NULL THEN true ELSE false END as has_image
 		FROM articles 
 		WHERE title LIKE ? OR description LIKE ? OR author LIKE ?
@@ -109,7 +161,7 @@ func SearchArticles(db *sql.DB, term string) ([]Article, error) {
 	`
 
 	searchTerm := "%" + term + "%"
-	rows, err := db.Query(query, searchTerm, searchTerm, searchTerm)
+	rows, err := db.QueryContext(ctx, query, searchTerm, searchTerm, searchTerm)
 	if err != nil {
 		return nil, err
 	}
@@ -119,6 +171,7 @@ func SearchArticles(db *sql.DB, term string) ([]Article, error) {
 
 	for rows.Next() {
 		var article Article
+		var featuredMediaID sql.NullInt64
 		err := rows.Scan(
 			&article.ID,
 			&article.Title,
@@ -127,11 +180,14 @@ func SearchArticles(db *sql.DB, term string) ([]Article, error) {
 			&article.Author,
 			&article.CreatedAt,
 			&article.UpdatedAt,
+			&article.Version,
+			&featuredMediaID,
 			&article.HasImage,
 		)
 		if err != nil {
 			return nil, err
 		}
+		article.FeaturedMediaID = int(featuredMediaID.Int64)
 		articles = append(articles, article)
 	}
 
@@ -139,23 +195,29 @@ func SearchArticles(db *sql.DB, term string) ([]Article, error) {
 		return nil, err
 	}
 
+	if err := loadListDetails(ctx, db, articles); err != nil {
+		return nil, err
+	}
+
 	return articles, nil
 }
 
 // CreateArticle inserts a new article into the database
-func CreateArticle(db *sql.DB, article *Article) (int, error) {
+func CreateArticle(ctx context.Context, db DBTX, article *Article) (int, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	query := `
-		INSERT INTO articles (title, description, image_url, author, image_data, image_type)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO articles (title, description, image_url, author, featured_media_id)
+		VALUES (?, ?, ?, ?, ?)
 	`
 
-	result, err := db.Exec(query,
+	result, err := db.ExecContext(ctx, query,
 		article.Title,
 		article.Description,
 		article.ImageURL,
 		article.Author,
-		article.ImageBlob,
-		article.ImageType,
+		nullableID(article.FeaturedMediaID),
 	)
 	if err != nil {
 		return 0, err
@@ -166,68 +228,119 @@ func CreateArticle(db *sql.DB, article *Article) (int, error) {
 		return 0, err
 	}
 
+	if article.Authors != nil {
+		if err := SetArticleAuthors(ctx, db, int(id), article.Authors); err != nil {
+			return 0, err
+		}
+	}
+
 	return int(id), nil
 }
 
-// UpdateArticle updates an existing article in the database
-func UpdateArticle(db *sql.DB, article *Article) error {
-	var query string
-	var args []interface{}
-
-	// If new image data is provided, update the image as well
-	if article.ImageBlob != nil {
-		query = `
-			UPDATE articles 
-			SET title = ?, description = ?, image_url = ?, author = ?, image_data = ?, image_type = ?
-			WHERE id = ?
-		`
-		args = []interface{}{
-			article.Title,
-			article.Description,
-			article.ImageURL,
-			article.Author,
-			article.ImageBlob,
-			article.ImageType,
-			article.ID,
+// UpdateArticle updates an existing article in the database. The update only
+// succeeds if article.Version still matches the stored version; otherwise
+// ErrVersionConflict is returned. On success article.Version is incremented.
+func UpdateArticle(ctx context.Context, db DBTX, article *Article) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE articles 
+		SET title = ?, description = ?, image_url = ?, author = ?, featured_media_id = ?,
+		    version = version + 1
+		WHERE id = ? AND version = ?
+	`
+
+	result, err := db.ExecContext(ctx, query,
+		article.Title,
+		article.Description,
+		article.ImageURL,
+		article.Author,
+		nullableID(article.FeaturedMediaID),
+		article.ID,
+		article.Version,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		// Nothing matched: either the article is gone or its version moved on
+		var exists bool
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM articles WHERE id = ?", article.ID).Scan(&exists)
+		if err != nil {
+			return err
 		}
-	} else {
-		// Otherwise only update the text fields and image URL
-		query = `
-			UPDATE articles 
-			SET title = ?, description = ?, image_url = ?, author = ?
-			WHERE id = ?
-		`
-		args = []interface{}{
-			article.Title,
-			article.Description,
-			article.ImageURL,
-			article.Author,
-			article.ID,
+		if !exists {
+			return &NotFoundError{Kind: "article", Key: article.ID}
 		}
+		return ErrVersionConflict
 	}
 
-	_, err := db.Exec(query, args...)
-	return err
+	article.Version++
+
+	if article.Authors != nil {
+		return SetArticleAuthors(ctx, db, article.ID, article.Authors)
+	}
+	return nil
 }
 
 // DeleteArticle removes an article from the database by ID
-func DeleteArticle(db *sql.DB, id int) error {
+func DeleteArticle(ctx context.Context, db DBTX, id int) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
 	query := "DELETE FROM articles WHERE id = ?"
-	_, err := db.Exec(query, id)
+	_, err := db.ExecContext(ctx, query, id)
 	return err
 }
 
-// GetImageByArticleID retrieves the image data for a specific article
-func GetImageByArticleID(db *sql.DB, id int) ([]byte, string, error) {
-	query := "SELECT image_data, image_type FROM articles WHERE id = ? AND image_data IS NOT NULL"
+// GetImageByArticleID retrieves the image data for a specific article: the
+// legacy inline image, or else the featured image from the media library
+func GetImageByArticleID(ctx context.Context, db DBTX, id int) ([]byte, string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT COALESCE(a.image_data, m.data), COALESCE(a.image_type, m.content_type, '')
+		FROM articles a
+		LEFT JOIN media m ON m.id = a.featured_media_id
+		WHERE a.id = ? AND (a.image_data IS NOT NULL OR m.id IS NOT NULL)
+	`
 
 	var imageData []byte
 	var imageType string
 
-	err := db.QueryRow(query, id).Scan(&imageData, &imageType)
+	err := db.QueryRowContext(ctx, query, id).Scan(&imageData, &imageType)
 	if err != nil {
-		return nil, "", err
+		return nil, "", notFound(err, "image of article", id)
 	}
 
 	return imageData, imageType, nil
 }
+
+// loadListDetails fills in the authors and featured images of a slice of articles
+func loadListDetails(ctx context.Context, db DBTX, articles []Article) error {
+	ptrs := make([]*Article, len(articles))
+	for i := range articles {
+		ptrs[i] = &articles[i]
+	}
+
+	if err := loadArticleAuthors(ctx, db, ptrs); err != nil {
+		return err
+	}
+	return loadArticleMedia(ctx, db, ptrs, false)
+}
+
+// nullableID maps the zero ID to NULL for optional foreign keys
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
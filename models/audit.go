@@ -0,0 +1,261 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuditEntry records a change someone made. Entries are only ever added,
+// never changed or removed.
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	Actor      string    `json:"actor"`       // User name, empty for anonymous requests
+	Action     string    `json:"action"`      // What was done, e.g. "settings.update"
+	TargetType string    `json:"target_type"` // Kind of record changed, e.g. "settings"
+	TargetID   string    `json:"target_id"`   // ID or slug of the record, if any
+	Before     string    `json:"before"`      // JSON snapshot before the change, if any
+	After      string    `json:"after"`       // JSON snapshot after the change, if any
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Snapshot encodes a record for the Before or After of an audit entry. A
+// nil record, such as the state before a create, is empty.
+func Snapshot(record interface{}) (string, error) {
+	if record == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(record)
+	return string(data), err
+}
+
+// RecordAudit appends an entry to the audit log. db should be the
+// transaction making the change the entry records.
+func RecordAudit(ctx context.Context, db DBTX, entry *AuditEntry) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO audit_log (actor, action, target_type, target_id, before_data, after_data, ip, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP(6))
+	`
+
+	// Browsers send long user agents and proxies long names; keep every
+	// value within its column rather than lose the entry
+	result, err := db.ExecContext(ctx, query,
+		truncate(entry.Actor, 100),
+		truncate(entry.Action, 50),
+		truncate(entry.TargetType, 50),
+		truncate(entry.TargetID, 120),
+		sql.NullString{String: entry.Before, Valid: entry.Before != ""},
+		sql.NullString{String: entry.After, Valid: entry.After != ""},
+		truncate(entry.IP, 45),
+		truncate(entry.UserAgent, 255),
+	)
+	if err != nil {
+		return err
+	}
+
+	entry.ID, err = result.LastInsertId()
+	return err
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      time.Time // Entries at or after this time
+	Until      time.Time // Entries before this time
+	BeforeID   int64     // Entries older than this one, for paging
+	Limit      int       // 0 for no limit
+}
+
+// where builds the WHERE clause and arguments of the filter
+func (f *AuditFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	add := func(cond string, arg interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if f.Actor != "" {
+		add("actor = ?", f.Actor)
+	}
+	if f.Action != "" {
+		add("action = ?", f.Action)
+	}
+	if f.TargetType != "" {
+		add("target_type = ?", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = ?", f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		add("created_at < ?", f.Until.UTC())
+	}
+	if f.BeforeID > 0 {
+		add("id < ?", f.BeforeID)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// GetAuditEntries returns the entries matching filter, newest first
+func GetAuditEntries(ctx context.Context, db DBTX, filter AuditFilter) ([]AuditEntry, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var entries []AuditEntry
+	err := EachAuditEntry(ctx, db, filter, func(entry *AuditEntry) error {
+		entries = append(entries, *entry)
+		return nil
+	})
+	return entries, err
+}
+
+// EachAuditEntry calls fn with every entry matching filter, newest first,
+// without holding them all in memory. It stops at the first error fn
+// returns. An export may take a while, so the query timeout doesn't apply;
+// cancel ctx to stop it.
+func EachAuditEntry(ctx context.Context, db DBTX, filter AuditFilter, fn func(*AuditEntry) error) error {
+	where, args := filter.where()
+	query := `
+		SELECT id, actor, action, target_type, target_id, before_data, after_data, ip, user_agent, created_at
+		FROM audit_log` + where + `
+		ORDER BY id DESC
+	`
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after sql.NullString
+		err := rows.Scan(
+			&entry.ID,
+			&entry.Actor,
+			&entry.Action,
+			&entry.TargetType,
+			&entry.TargetID,
+			&before,
+			&after,
+			&entry.IP,
+			&entry.UserAgent,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		entry.Before = before.String
+		entry.After = after.String
+
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// AuditChange is a field that differs between the snapshots of an entry
+type AuditChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// Changes compares the snapshots of the entry field by field and returns
+// the fields that differ, sorted by name. Either snapshot may be empty, as
+// for a create or a delete.
+func (e *AuditEntry) Changes() ([]AuditChange, error) {
+	before, err := decodeSnapshot(e.Before)
+	if err != nil {
+		return nil, fmt.Errorf("audit entry %d: %v", e.ID, err)
+	}
+	after, err := decodeSnapshot(e.After)
+	if err != nil {
+		return nil, fmt.Errorf("audit entry %d: %v", e.ID, err)
+	}
+
+	fields := make(map[string]bool)
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+
+	var changes []AuditChange
+	for field := range fields {
+		old, hadOld := before[field]
+		value, hasValue := after[field]
+		if hadOld == hasValue && reflect.DeepEqual(old, value) {
+			continue
+		}
+		changes = append(changes, AuditChange{
+			Field:  field,
+			Before: formatSnapshotValue(old, hadOld),
+			After:  formatSnapshotValue(value, hasValue),
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// decodeSnapshot decodes a snapshot of a record into its fields
+func decodeSnapshot(snapshot string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if snapshot == "" {
+		return fields, nil
+	}
+	if err := json.Unmarshal([]byte(snapshot), &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// formatSnapshotValue shows a snapshot field as text: strings as they are,
+// anything else as JSON
+func formatSnapshotValue(value interface{}, ok bool) string {
+	if !ok || value == nil {
+		return ""
+	}
+	if s, isString := value.(string); isString {
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
@@ -0,0 +1,558 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Author is a person credited in article bylines
+type Author struct {
+	ID          int               `json:"id"`
+	Name        string            `json:"name"`
+	Slug        string            `json:"slug"`
+	Bio         string            `json:"bio"`
+	AvatarURL   string            `json:"avatar_url"`
+	SocialLinks map[string]string `json:"social_links"` // Network name to profile URL
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// SocialNetworks lists the social links offered in the author form, in display order
+var SocialNetworks = []string{"website", "x", "facebook", "instagram", "linkedin"}
+
+// Limits of the author columns checked by Validate, besides
+// MaxAuthorNameLength
+const (
+	MaxAuthorSlugLength = 120   // authors.slug VARCHAR(120)
+	MaxAuthorBioLength  = 65535 // authors.bio TEXT, in bytes
+	MaxAvatarURLLength  = 255   // authors.avatar_url VARCHAR(255)
+	MaxSocialLinkLength = 255   // Each link, so all fit authors.social_links TEXT
+)
+
+// reservedSlugs can't be used by authors because they are routes under /authors/
+var reservedSlugs = map[string]bool{"new": true, "edit": true, "update": true}
+
+// Slugify turns an author name into the URL slug used for de-duplication
+// and profile pages: lower case letters and digits separated by hyphens
+func Slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+
+	slug := b.String()
+	if slug == "" {
+		slug = "author"
+	}
+	if reservedSlugs[slug] {
+		slug += "-author"
+	}
+	return slug
+}
+
+// Validate normalizes the author's text fields and checks them against the
+// limits of the columns they are stored in. It returns ValidationErrors
+// naming every invalid field, or nil. Social links are reported under
+// social_ followed by the network.
+func (a *Author) Validate() error {
+	var errs ValidationErrors
+
+	a.Name = NormalizeAuthorName(normalizeText(a.Name, false))
+	a.Bio = normalizeText(a.Bio, true)
+	a.AvatarURL = strings.TrimSpace(a.AvatarURL)
+
+	switch {
+	case a.Name == "":
+		errs.add("name", "name is required")
+	case utf8.RuneCountInString(a.Name) > MaxAuthorNameLength:
+		errs.add("name", "name must be at most %d characters", MaxAuthorNameLength)
+	case htmlTag.MatchString(a.Name):
+		errs.add("name", "name must not contain HTML tags")
+	}
+
+	if len(a.Slug) > MaxAuthorSlugLength {
+		errs.add("slug", "slug must be at most %d characters", MaxAuthorSlugLength)
+	}
+	if len(a.Bio) > MaxAuthorBioLength {
+		errs.add("bio", "bio must be at most %d KB", MaxAuthorBioLength>>10)
+	}
+
+	if a.AvatarURL != "" {
+		switch {
+		case utf8.RuneCountInString(a.AvatarURL) > MaxAvatarURLLength:
+			errs.add("avatar_url", "avatar URL must be at most %d characters", MaxAvatarURLLength)
+		case !IsWebURL(a.AvatarURL):
+			errs.add("avatar_url", "avatar URL must be an http or https URL")
+		}
+	}
+
+	for _, network := range SocialNetworks {
+		link, ok := a.SocialLinks[network]
+		switch {
+		case !ok:
+		case utf8.RuneCountInString(link) > MaxSocialLinkLength:
+			errs.add("social_"+network, "the %s link must be at most %d characters", network, MaxSocialLinkLength)
+		case !IsWebURL(link):
+			errs.add("social_"+network, "the %s link must be an http or https URL", network)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// NormalizeAuthorName trims an author name and collapses inner whitespace
+func NormalizeAuthorName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// Byline joins author names for display, e.g. "A, B and C"
+func Byline(names []string) string {
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0]
+	default:
+		return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	}
+}
+
+// AuthorNames returns the names of the article's authors in byline order,
+// falling back to the stored byline for articles without linked authors
+func (a *Article) AuthorNames() []string {
+	if len(a.Authors) == 0 {
+		if a.Author == "" {
+			return nil
+		}
+		return []string{a.Author}
+	}
+
+	names := make([]string, len(a.Authors))
+	for i, author := range a.Authors {
+		names[i] = author.Name
+	}
+	return names
+}
+
+const authorColumns = "id, name, slug, bio, avatar_url, social_links, created_at, updated_at"
+
+// scanAuthor scans a row selected with authorColumns. Destinations for any
+// columns selected before the author columns are passed in leading.
+func scanAuthor(scan func(dest ...interface{}) error, leading ...interface{}) (*Author, error) {
+	var author Author
+	var bio, avatarURL, socialLinks sql.NullString
+	err := scan(append(leading,
+		&author.ID,
+		&author.Name,
+		&author.Slug,
+		&bio,
+		&avatarURL,
+		&socialLinks,
+		&author.CreatedAt,
+		&author.UpdatedAt,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	author.Bio = bio.String
+	author.AvatarURL = avatarURL.String
+	author.SocialLinks = map[string]string{}
+	if socialLinks.String != "" {
+		if err := json.Unmarshal([]byte(socialLinks.String), &author.SocialLinks); err != nil {
+			return nil, fmt.Errorf("invalid social links for author %d: %v", author.ID, err)
+		}
+	}
+
+	return &author, nil
+}
+
+// GetAuthors fetches all authors ordered by name
+func GetAuthors(ctx context.Context, db DBTX) ([]Author, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT "+authorColumns+" FROM authors ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var authors []Author
+
+	for rows.Next() {
+		author, err := scanAuthor(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		authors = append(authors, *author)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return authors, nil
+}
+
+// GetAuthorByID fetches a single author by ID
+func GetAuthorByID(ctx context.Context, db DBTX, id int) (*Author, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	author, err := scanAuthor(db.QueryRowContext(ctx, "SELECT "+authorColumns+" FROM authors WHERE id = ?", id).Scan)
+	return author, notFound(err, "author", id)
+}
+
+// GetAuthorBySlug fetches a single author by slug
+func GetAuthorBySlug(ctx context.Context, db DBTX, slug string) (*Author, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	author, err := scanAuthor(db.QueryRowContext(ctx, "SELECT "+authorColumns+" FROM authors WHERE slug = ?", slug).Scan)
+	return author, notFound(err, "author", slug)
+}
+
+// CreateAuthor inserts a new author. An empty slug is derived from the name;
+// a numeric suffix is added when the slug is already taken.
+func CreateAuthor(ctx context.Context, db DBTX, author *Author) (int, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	base := author.Slug
+	if base == "" {
+		base = Slugify(author.Name)
+	}
+
+	slug, err := uniqueSlug(ctx, db, base, 0)
+	if err != nil {
+		return 0, err
+	}
+	author.Slug = slug
+
+	socialLinks, err := json.Marshal(author.SocialLinks)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO authors (name, slug, bio, avatar_url, social_links)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	result, err := db.ExecContext(ctx, query, author.Name, author.Slug, author.Bio, author.AvatarURL, string(socialLinks))
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	author.ID = int(id)
+	return author.ID, nil
+}
+
+// UpdateAuthor updates an author's profile
+func UpdateAuthor(ctx context.Context, db DBTX, author *Author) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	slug, err := uniqueSlug(ctx, db, author.Slug, author.ID)
+	if err != nil {
+		return err
+	}
+	author.Slug = slug
+
+	socialLinks, err := json.Marshal(author.SocialLinks)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE authors
+		SET name = ?, slug = ?, bio = ?, avatar_url = ?, social_links = ?
+		WHERE id = ?
+	`
+
+	_, err = db.ExecContext(ctx, query, author.Name, author.Slug, author.Bio, author.AvatarURL, string(socialLinks), author.ID)
+	if err != nil {
+		return err
+	}
+
+	// Keep the stored bylines of the author's articles in sync with the name
+	return refreshBylines(ctx, db, author.ID, "name")
+}
+
+// MergeAuthors credits the articles of the author from to the author into
+// instead and deletes from, for one person entered under two names such as
+// "J. Smith" and "John Smith". An article crediting both keeps into in its
+// place in the byline.
+func MergeAuthors(ctx context.Context, db DBTX, from, into int) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	if from == into {
+		return &ValidationError{Field: "into", Message: "an author can't be merged into themselves"}
+	}
+
+	_, err := db.ExecContext(ctx, `
+		DELETE f FROM article_authors f
+		JOIN article_authors i ON i.article_id = f.article_id AND i.author_id = ?
+		WHERE f.author_id = ?
+	`, into, from)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE article_authors SET author_id = ? WHERE author_id = ?", into, from); err != nil {
+		return err
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM authors WHERE id = ?", from)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return &NotFoundError{Kind: "author", Key: from}
+	}
+
+	return refreshBylines(ctx, db, into, "into")
+}
+
+// uniqueSlug returns base, or base with a numeric suffix, such that no author
+// other than excludeID uses it
+func uniqueSlug(ctx context.Context, db DBTX, base string, excludeID int) (string, error) {
+	slug := base
+	for i := 2; ; i++ {
+		var taken bool
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM authors WHERE slug = ? AND id <> ?", slug, excludeID).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// FindOrCreateAuthors resolves author names to authors, matching existing
+// authors by slug so spelling variants like "john smith" and "John  Smith"
+// map to the same person, and creating authors for unknown names
+func FindOrCreateAuthors(ctx context.Context, db DBTX, names []string) ([]Author, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var authors []Author
+	seen := make(map[int]bool)
+
+	for _, name := range names {
+		name = NormalizeAuthorName(name)
+		if name == "" {
+			continue
+		}
+
+		author, err := GetAuthorBySlug(ctx, db, Slugify(name))
+		if IsNotFound(err) {
+			author = &Author{Name: name}
+			_, err = CreateAuthor(ctx, db, author)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[author.ID] {
+			seen[author.ID] = true
+			authors = append(authors, *author)
+		}
+	}
+
+	return authors, nil
+}
+
+// SetArticleAuthors replaces the authors of an article, keeping their order
+func SetArticleAuthors(ctx context.Context, db DBTX, articleID int, authors []Author) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM article_authors WHERE article_id = ?", articleID); err != nil {
+		return err
+	}
+
+	for position, author := range authors {
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO article_authors (article_id, author_id, position) VALUES (?, ?, ?)",
+			articleID, author.ID, position,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadArticleAuthors fills in the Authors of the given articles
+func loadArticleAuthors(ctx context.Context, db DBTX, articles []*Article) error {
+	if len(articles) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Article, len(articles))
+	placeholders := make([]string, 0, len(articles))
+	args := make([]interface{}, 0, len(articles))
+	for _, article := range articles {
+		byID[article.ID] = article
+		placeholders = append(placeholders, "?")
+		args = append(args, article.ID)
+	}
+
+	query := `
+		SELECT aa.article_id, a.id, a.name, a.slug, a.bio, a.avatar_url, a.social_links, a.created_at, a.updated_at
+		FROM article_authors aa
+		JOIN authors a ON a.id = aa.author_id
+		WHERE aa.article_id IN (` + strings.Join(placeholders, ", ") + `)
+		ORDER BY aa.article_id, aa.position
+	`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var articleID int
+		author, err := scanAuthor(rows.Scan, &articleID)
+		if err != nil {
+			return err
+		}
+		article := byID[articleID]
+		article.Authors = append(article.Authors, *author)
+	}
+
+	return rows.Err()
+}
+
+// GetArticlesByAuthor fetches an author's articles, newest first
+func GetArticlesByAuthor(ctx context.Context, db DBTX, authorID int) ([]Article, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT a.id, a.title, a.description, a.image_url, a.author, a.created_at, a.updated_at, a.version, a.featured_media_id,
+		       CASE WHEN a.image_data IS NOT NULL THEN true ELSE false END as has_image
+		FROM articles a
+		JOIN article_authors aa ON aa.article_id = a.id
+		WHERE aa.author_id = ?
+		ORDER BY a.created_at DESC
+	`
+
+	rows, err := db.QueryContext(ctx, query, authorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var articles []Article
+
+	for rows.Next() {
+		var article Article
+		var featuredMediaID sql.NullInt64
+		err := rows.Scan(
+			&article.ID,
+			&article.Title,
+			&article.Description,
+			&article.ImageURL,
+			&article.Author,
+			&article.CreatedAt,
+			&article.UpdatedAt,
+			&article.Version,
+			&featuredMediaID,
+			&article.HasImage,
+		)
+		if err != nil {
+			return nil, err
+		}
+		article.FeaturedMediaID = int(featuredMediaID.Int64)
+		articles = append(articles, article)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := loadListDetails(ctx, db, articles); err != nil {
+		return nil, err
+	}
+
+	return articles, nil
+}
+
+// refreshBylines rewrites the stored byline of every article by the author.
+// If a byline would no longer fit its column nothing is rewritten, and a
+// ValidationError for field is returned.
+func refreshBylines(ctx context.Context, db DBTX, authorID int, field string) error {
+	rows, err := db.QueryContext(ctx, "SELECT article_id FROM article_authors WHERE author_id = ?", authorID)
+	if err != nil {
+		return err
+	}
+
+	var articles []*Article
+	for rows.Next() {
+		var article Article
+		if err := rows.Scan(&article.ID); err != nil {
+			rows.Close()
+			return err
+		}
+		articles = append(articles, &article)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := loadArticleAuthors(ctx, db, articles); err != nil {
+		return err
+	}
+
+	for _, article := range articles {
+		article.Author = Byline(article.AuthorNames())
+		if utf8.RuneCountInString(article.Author) > MaxBylineLength {
+			return &ValidationError{
+				Field:   field,
+				Message: fmt.Sprintf("the byline of article %d would be longer than %d characters", article.ID, MaxBylineLength),
+			}
+		}
+	}
+
+	for _, article := range articles {
+		// Leave updated_at alone; the article content didn't change
+		_, err := db.ExecContext(ctx, "UPDATE articles SET author = ?, updated_at = updated_at WHERE id = ?", article.Author, article.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
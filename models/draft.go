@@ -0,0 +1,117 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Draft is an autosaved copy of the article form for one user. ArticleID is
+// 0 for an article that hasn't been created yet.
+type Draft struct {
+	UserName    string   `json:"-"`
+	ArticleID   int      `json:"article_id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	ImageURL    string   `json:"image_url"`
+	Authors     []string `json:"authors"`
+
+	FeaturedMediaID int       `json:"featured_media_id"` // 0 for no featured image
+	SavedAt         time.Time `json:"saved_at"`
+}
+
+// SaveDraft validates the draft and stores it, replacing the user's
+// previous autosave of the same article, and sets draft.SavedAt
+func SaveDraft(ctx context.Context, db DBTX, draft *Draft) error {
+	if err := draft.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	draft.SavedAt = time.Now().UTC().Truncate(time.Second)
+
+	query := `
+		INSERT INTO article_drafts (user_name, article_id, title, description, image_url, author, featured_media_id, saved_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			title = VALUES(title),
+			description = VALUES(description),
+			image_url = VALUES(image_url),
+			author = VALUES(author),
+			featured_media_id = VALUES(featured_media_id),
+			saved_at = VALUES(saved_at)
+	`
+
+	_, err := db.ExecContext(ctx, query,
+		draft.UserName,
+		draft.ArticleID,
+		draft.Title,
+		draft.Description,
+		draft.ImageURL,
+		strings.Join(draft.Authors, "\n"),
+		draft.FeaturedMediaID,
+		draft.SavedAt,
+	)
+	return err
+}
+
+// GetDraft returns the user's latest autosave of an article, or nil if there is none
+func GetDraft(ctx context.Context, db DBTX, user string, articleID int) (*Draft, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT user_name, article_id, title, description, image_url, author, featured_media_id, saved_at
+		FROM article_drafts WHERE user_name = ? AND article_id = ?
+	`
+
+	var draft Draft
+	var imageURL sql.NullString
+	var authors string
+	err := db.QueryRowContext(ctx, query, user, articleID).Scan(
+		&draft.UserName,
+		&draft.ArticleID,
+		&draft.Title,
+		&draft.Description,
+		&imageURL,
+		&authors,
+		&draft.FeaturedMediaID,
+		&draft.SavedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	draft.ImageURL = imageURL.String
+	// Author names are stored one per line
+	if authors != "" {
+		draft.Authors = strings.Split(authors, "\n")
+	}
+	return &draft, nil
+}
+
+// DeleteDraft removes the user's autosave of an article
+func DeleteDraft(ctx context.Context, db DBTX, user string, articleID int) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := "DELETE FROM article_drafts WHERE user_name = ? AND article_id = ?"
+	_, err := db.ExecContext(ctx, query, user, articleID)
+	return err
+}
+
+// DeleteArticleDrafts removes every user's autosaves of an article
+func DeleteArticleDrafts(ctx context.Context, db DBTX, articleID int) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := "DELETE FROM article_drafts WHERE article_id = ?"
+	_, err := db.ExecContext(ctx, query, articleID)
+	return err
+}
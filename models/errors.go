@@ -0,0 +1,56 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// The error types below describe what went wrong in terms a visitor can be
+// shown. Any other error returned by this package is an internal failure,
+// such as a lost database connection, whose details are only for the logs.
+
+// NotFoundError is returned when a record doesn't exist
+type NotFoundError struct {
+	Kind string      // What was looked up, e.g. "article"
+	Key  interface{} // The ID or slug it was looked up by
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %v not found", e.Kind, e.Key)
+}
+
+// ConflictError is returned when a change can't be applied because the
+// record changed in the meantime
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// ValidationError is returned for input that can't be saved
+type ValidationError struct {
+	Field   string // The form field at fault, if there is one
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// IsNotFound reports whether err is or wraps a NotFoundError
+func IsNotFound(err error) bool {
+	var notFound *NotFoundError
+	return errors.As(err, &notFound)
+}
+
+// notFound turns sql.ErrNoRows from looking up a kind of record by key into
+// a NotFoundError and returns other errors unchanged
+func notFound(err error, kind string, key interface{}) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return &NotFoundError{Kind: kind, Key: key}
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ImageCheck is the result of the latest check of a hot-linked article image
+type ImageCheck struct {
+	URL       string    `json:"url"`
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// GetExternalImageURLs returns the distinct remote image URLs articles
+// display, i.e. those of articles without a featured image from the library
+func GetExternalImageURLs(ctx context.Context, db DBTX) ([]string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT DISTINCT image_url FROM articles
+		WHERE image_url IS NOT NULL AND image_url <> '' AND featured_media_id IS NULL
+	`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, rows.Err()
+}
+
+// SaveImageCheck records the result of checking an image URL
+func SaveImageCheck(ctx context.Context, db DBTX, check *ImageCheck) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO image_checks (url, ok, error, checked_at)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			ok = VALUES(ok),
+			error = VALUES(error),
+			checked_at = VALUES(checked_at)
+	`
+
+	// Error messages can quote long URLs; keep them within the column
+	message := check.Error
+	if runes := []rune(message); len(runes) > 255 {
+		message = string(runes[:255])
+	}
+
+	_, err := db.ExecContext(ctx, query, check.URL, check.OK, message, check.CheckedAt)
+	return err
+}
+
+// PruneImageChecks removes the results for URLs no article uses any more
+func PruneImageChecks(ctx context.Context, db DBTX) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		DELETE FROM image_checks
+		WHERE url NOT IN (SELECT image_url FROM articles WHERE image_url IS NOT NULL)
+	`
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// GetBrokenImages returns the failed checks keyed by URL
+func GetBrokenImages(ctx context.Context, db DBTX) (map[string]*ImageCheck, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT url, ok, error, checked_at FROM image_checks WHERE NOT ok")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := make(map[string]*ImageCheck)
+
+	for rows.Next() {
+		var check ImageCheck
+		var message sql.NullString
+		if err := rows.Scan(&check.URL, &check.OK, &message, &check.CheckedAt); err != nil {
+			return nil, err
+		}
+		check.Error = message.String
+		checks[check.URL] = &check
+	}
+
+	return checks, rows.Err()
+}
+
+// GetImageCheck returns the latest check of an image URL, or nil if it
+// hasn't been checked
+func GetImageCheck(ctx context.Context, db DBTX, url string) (*ImageCheck, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var check ImageCheck
+	var message sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT url, ok, error, checked_at FROM image_checks WHERE url = ?", url).Scan(
+		&check.URL,
+		&check.OK,
+		&message,
+		&check.CheckedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	check.Error = message.String
+	return &check, nil
+}
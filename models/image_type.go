@@ -0,0 +1,77 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedImage is returned for data that isn't one of ImageTypes
+	ErrUnsupportedImage error = &ValidationError{Message: "not a supported image type (JPEG, PNG, GIF or WebP)"}
+	// ErrImageTooLarge is returned for images over their type's size limit
+	ErrImageTooLarge error = &ValidationError{Message: "image is too large"}
+)
+
+// ImageType is an image format accepted into the media library
+type ImageType struct {
+	Extension string
+	MaxBytes  int // Further capped by the configured upload or fetch limit
+}
+
+// ImageTypes are the accepted image formats by content type. The type is
+// always detected from the data, never taken from the file name or the
+// client. SVG is refused because it can carry scripts and HTML that would
+// run on our domain.
+var ImageTypes = map[string]ImageType{
+	"image/jpeg": {".jpg", 10 << 20},
+	"image/png":  {".png", 10 << 20},
+	"image/webp": {".webp", 10 << 20},
+	"image/gif":  {".gif", 5 << 20}, // Animated GIFs are rarely worth more
+}
+
+// DetectImageType returns the content type of an image from its magic bytes
+func DetectImageType(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := ImageTypes[contentType]; !ok {
+		return "", fmt.Errorf("%w, got %s", ErrUnsupportedImage, contentType)
+	}
+	return contentType, nil
+}
+
+// ImageLimit returns the size limit for an image type, capped at maxBytes
+func ImageLimit(contentType string, maxBytes int) int {
+	if limit := ImageTypes[contentType].MaxBytes; limit < maxBytes {
+		return limit
+	}
+	return maxBytes
+}
+
+// CheckImage detects the type of an image and checks it against the type's
+// size limit, capped at maxBytes. It returns the detected content type.
+func CheckImage(data []byte, maxBytes int) (string, error) {
+	contentType, err := DetectImageType(data)
+	if err != nil {
+		return "", err
+	}
+	if limit := ImageLimit(contentType, maxBytes); len(data) > limit {
+		return "", fmt.Errorf("%w: %s images are limited to %d KB", ErrImageTooLarge, contentType, limit>>10)
+	}
+	return contentType, nil
+}
+
+// ImageFileName makes the extension of name match the detected content
+// type, so a PNG uploaded as photo.svg is stored as photo.svg.png
+func ImageFileName(name, contentType string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "image"
+	}
+	ext := ImageTypes[contentType].Extension
+	if ext == "" || strings.EqualFold(path.Ext(name), ext) ||
+		(ext == ".jpg" && strings.EqualFold(path.Ext(name), ".jpeg")) {
+		return name
+	}
+	return name + ext
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// EditLock is an advisory lock showing that a user is editing an article.
+// Locks expire unless renewed by the editor's heartbeat.
+type EditLock struct {
+	ArticleID  int       `json:"article_id"`
+	UserName   string    `json:"user_name"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// AcquireEditLock takes the edit lock on an article for user, renewing it if
+// the user already holds it. If another user holds an unexpired lock it is
+// left alone and returned with acquired set to false.
+func AcquireEditLock(ctx context.Context, db DBTX, articleID int, user string, ttl time.Duration) (*EditLock, bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// Assignments are evaluated left to right, so user_name is replaced only
+	// when the old lock expired and expires_at is extended only when the lock
+	// now belongs to user
+	query := `
+		INSERT INTO article_locks (article_id, user_name, acquired_at, expires_at)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			acquired_at = IF(expires_at <= VALUES(acquired_at), VALUES(acquired_at), acquired_at),
+			user_name = IF(expires_at <= VALUES(acquired_at), VALUES(user_name), user_name),
+			expires_at = IF(user_name = VALUES(user_name), VALUES(expires_at), expires_at)
+	`
+
+	if _, err := db.ExecContext(ctx, query, articleID, user, now, now.Add(ttl)); err != nil {
+		return nil, false, err
+	}
+
+	lock, err := GetEditLock(ctx, db, articleID)
+	if err != nil {
+		return nil, false, err
+	}
+	if lock == nil {
+		// The article was deleted in the meantime
+		return nil, false, &NotFoundError{Kind: "article", Key: articleID}
+	}
+
+	return lock, lock.UserName == user, nil
+}
+
+// TakeOverEditLock gives the edit lock on an article to user regardless of
+// who holds it
+func TakeOverEditLock(ctx context.Context, db DBTX, articleID int, user string, ttl time.Duration) (*EditLock, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	query := `
+		INSERT INTO article_locks (article_id, user_name, acquired_at, expires_at)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			user_name = VALUES(user_name),
+			acquired_at = VALUES(acquired_at),
+			expires_at = VALUES(expires_at)
+	`
+
+	if _, err := db.ExecContext(ctx, query, articleID, user, now, now.Add(ttl)); err != nil {
+		return nil, err
+	}
+
+	return &EditLock{
+		ArticleID:  articleID,
+		UserName:   user,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}, nil
+}
+
+// ReleaseEditLock removes the edit lock on an article if user holds it
+func ReleaseEditLock(ctx context.Context, db DBTX, articleID int, user string) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := "DELETE FROM article_locks WHERE article_id = ? AND user_name = ?"
+	_, err := db.ExecContext(ctx, query, articleID, user)
+	return err
+}
+
+// GetEditLock returns the unexpired edit lock on an article, or nil if the
+// article isn't locked
+func GetEditLock(ctx context.Context, db DBTX, articleID int) (*EditLock, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT article_id, user_name, acquired_at, expires_at
+		FROM article_locks WHERE article_id = ? AND expires_at > ?
+	`
+
+	var lock EditLock
+	err := db.QueryRowContext(ctx, query, articleID, time.Now().UTC()).Scan(
+		&lock.ArticleID,
+		&lock.UserName,
+		&lock.AcquiredAt,
+		&lock.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &lock, nil
+}
+
+// GetActiveEditLocks returns all unexpired edit locks keyed by article ID
+func GetActiveEditLocks(ctx context.Context, db DBTX) (map[int]*EditLock, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT article_id, user_name, acquired_at, expires_at
+		FROM article_locks WHERE expires_at > ?
+	`
+
+	rows, err := db.QueryContext(ctx, query, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locks := make(map[int]*EditLock)
+
+	for rows.Next() {
+		var lock EditLock
+		err := rows.Scan(
+			&lock.ArticleID,
+			&lock.UserName,
+			&lock.AcquiredAt,
+			&lock.ExpiresAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		locks[lock.ArticleID] = &lock
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return locks, nil
+}
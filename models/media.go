@@ -0,0 +1,320 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media is an image in the media library. Assets are shared between
+// articles, either as the featured image or inline in the article body.
+type Media struct {
+	ID          int       `json:"id"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	Data        []byte    `json:"-"` // Only loaded by GetMediaData
+	AltText     string    `json:"alt_text"`
+	Caption     string    `json:"caption"`
+	Credit      string    `json:"credit"`     // Photographer or agency
+	SourceURL   string    `json:"source_url"` // Remote URL the image was copied from
+	UploadedBy  string    `json:"uploaded_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// URL returns the path the asset is served from
+func (m *Media) URL() string {
+	return "/media/" + strconv.Itoa(m.ID)
+}
+
+const mediaColumns = `id, file_name, content_type, LENGTH(data), alt_text, caption, credit,
+	source_url, uploaded_by, created_at, updated_at`
+
+// scanMedia scans a row selected with mediaColumns
+func scanMedia(scan func(dest ...interface{}) error) (*Media, error) {
+	var media Media
+	var altText, caption, credit, sourceURL, uploadedBy sql.NullString
+	err := scan(
+		&media.ID,
+		&media.FileName,
+		&media.ContentType,
+		&media.Size,
+		&altText,
+		&caption,
+		&credit,
+		&sourceURL,
+		&uploadedBy,
+		&media.CreatedAt,
+		&media.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	media.AltText = altText.String
+	media.Caption = caption.String
+	media.Credit = credit.String
+	media.SourceURL = sourceURL.String
+	media.UploadedBy = uploadedBy.String
+	return &media, nil
+}
+
+// SearchMedia lists library assets, newest first, whose file name, alt
+// text, caption or credit contain term. An empty term lists everything.
+func SearchMedia(ctx context.Context, db DBTX, term string, limit int) ([]Media, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := "SELECT " + mediaColumns + " FROM media"
+	var args []interface{}
+
+	if term != "" {
+		query += " WHERE file_name LIKE ? OR alt_text LIKE ? OR caption LIKE ? OR credit LIKE ?"
+		searchTerm := "%" + term + "%"
+		args = append(args, searchTerm, searchTerm, searchTerm, searchTerm)
+	}
+
+	query += " ORDER BY created_at DESC, id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var media []Media
+
+	for rows.Next() {
+		m, err := scanMedia(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, *m)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+// GetMediaByID fetches an asset's details without its data
+func GetMediaByID(ctx context.Context, db DBTX, id int) (*Media, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	media, err := scanMedia(db.QueryRowContext(ctx, "SELECT "+mediaColumns+" FROM media WHERE id = ?", id).Scan)
+	return media, notFound(err, "media", id)
+}
+
+// GetMediaData fetches an asset's data and content type
+func GetMediaData(ctx context.Context, db DBTX, id int) ([]byte, string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var data []byte
+	var contentType string
+
+	err := db.QueryRowContext(ctx, "SELECT data, content_type FROM media WHERE id = ?", id).Scan(&data, &contentType)
+	if err != nil {
+		return nil, "", notFound(err, "media", id)
+	}
+
+	return data, contentType, nil
+}
+
+// CreateMedia adds an asset to the library
+func CreateMedia(ctx context.Context, db DBTX, media *Media) (int, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO media (file_name, content_type, data, alt_text, caption, credit, source_url, uploaded_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := db.ExecContext(ctx, query,
+		media.FileName,
+		media.ContentType,
+		media.Data,
+		media.AltText,
+		media.Caption,
+		media.Credit,
+		media.SourceURL,
+		media.UploadedBy,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	media.ID = int(id)
+	media.Size = len(media.Data)
+	return media.ID, nil
+}
+
+// UpdateMedia updates an asset's alt text, caption and credit. The image
+// itself can't be replaced because articles may already show it.
+func UpdateMedia(ctx context.Context, db DBTX, media *Media) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	query := "UPDATE media SET alt_text = ?, caption = ?, credit = ? WHERE id = ?"
+
+	result, err := db.ExecContext(ctx, query, media.AltText, media.Caption, media.Credit, media.ID)
+	if err != nil {
+		return err
+	}
+
+	// MySQL reports 0 rows for an unchanged row, so check the ID exists
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		_, err := GetMediaByID(ctx, db, media.ID)
+		return err
+	}
+
+	return nil
+}
+
+// getMediaByIDs fetches the details of several assets keyed by ID. Unknown
+// IDs are left out.
+func getMediaByIDs(ctx context.Context, db DBTX, ids []int) (map[int]*Media, error) {
+	media := make(map[int]*Media)
+	if len(ids) == 0 {
+		return media, nil
+	}
+
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	query := "SELECT " + mediaColumns + " FROM media WHERE id IN (" + strings.Join(placeholders, ", ") + ")"
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := scanMedia(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		media[m.ID] = m
+	}
+
+	return media, rows.Err()
+}
+
+// mediaShortcode matches inline image references like [[media:42]] in
+// article bodies
+var mediaShortcode = regexp.MustCompile(`\[\[media:(\d+)\]\]`)
+
+// MediaShortcode returns the shortcode that embeds an asset in an article body
+func MediaShortcode(id int) string {
+	return "[[media:" + strconv.Itoa(id) + "]]"
+}
+
+// BodyPart is a piece of an article body: either text or an inline image
+type BodyPart struct {
+	Text  string
+	Media *Media
+}
+
+// Body splits the article description into text and the inline images
+// referenced by shortcodes. Shortcodes of deleted assets are dropped.
+func (a *Article) Body() []BodyPart {
+	var parts []BodyPart
+	var text strings.Builder
+	flushText := func() {
+		if t := strings.TrimSpace(text.String()); t != "" {
+			parts = append(parts, BodyPart{Text: t})
+		}
+		text.Reset()
+	}
+
+	last := 0
+	for _, m := range mediaShortcode.FindAllStringSubmatchIndex(a.Description, -1) {
+		text.WriteString(a.Description[last:m[0]])
+		last = m[1]
+
+		id, _ := strconv.Atoi(a.Description[m[2]:m[3]])
+		if media := a.InlineMedia[id]; media != nil {
+			flushText()
+			parts = append(parts, BodyPart{Media: media})
+		}
+	}
+	text.WriteString(a.Description[last:])
+	flushText()
+
+	return parts
+}
+
+// PlainText returns the article description without image shortcodes, for
+// excerpts
+func (a *Article) PlainText() string {
+	return strings.TrimSpace(mediaShortcode.ReplaceAllString(a.Description, ""))
+}
+
+// inlineMediaIDs returns the IDs of the assets embedded in the article body
+func (a *Article) inlineMediaIDs() []int {
+	var ids []int
+	for _, m := range mediaShortcode.FindAllStringSubmatch(a.Description, -1) {
+		if id, err := strconv.Atoi(m[1]); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// loadArticleMedia fills in the featured image of the given articles and,
+// when inline is set, the images embedded in their bodies
+func loadArticleMedia(ctx context.Context, db DBTX, articles []*Article, inline bool) error {
+	var ids []int
+	for _, article := range articles {
+		if article.FeaturedMediaID != 0 {
+			ids = append(ids, article.FeaturedMediaID)
+		}
+		if inline {
+			ids = append(ids, article.inlineMediaIDs()...)
+		}
+	}
+
+	media, err := getMediaByIDs(ctx, db, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, article := range articles {
+		article.FeaturedMedia = media[article.FeaturedMediaID]
+		if inline {
+			article.InlineMedia = make(map[int]*Media)
+			for _, id := range article.inlineMediaIDs() {
+				if m := media[id]; m != nil {
+					article.InlineMedia[id] = m
+				}
+			}
+		}
+	}
+
+	return nil
+}
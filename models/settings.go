@@ -0,0 +1,237 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits of the site settings
+const (
+	MaxSiteNameLength = 100
+	MaxTaglineLength  = 255
+	MaxPageSize       = 200
+)
+
+// Settings are the site-wide settings admins edit on the settings page.
+// Each field is stored as a row of the settings table under its key.
+type Settings struct {
+	SiteName    string            `json:"site_name"` // Empty uses the theme's site name
+	Tagline     string            `json:"tagline"`
+	PageSize    int               `json:"page_size"` // Articles on the article list
+	TimeZone    string            `json:"time_zone"` // IANA name dates are shown in
+	SocialLinks map[string]string `json:"social_links"`
+}
+
+// settingKeys binds each setting to its key in the settings table. The
+// field's type decides how the value is stored: strings as they are,
+// numbers in decimal and maps as JSON.
+var settingKeys = []struct {
+	key   string
+	field func(s *Settings) interface{}
+}{
+	{"site_name", func(s *Settings) interface{} { return &s.SiteName }},
+	{"tagline", func(s *Settings) interface{} { return &s.Tagline }},
+	{"page_size", func(s *Settings) interface{} { return &s.PageSize }},
+	{"time_zone", func(s *Settings) interface{} { return &s.TimeZone }},
+	{"social_links", func(s *Settings) interface{} { return &s.SocialLinks }},
+}
+
+// DefaultSettings returns the settings used until an admin changes them
+func DefaultSettings() *Settings {
+	return &Settings{
+		PageSize:    50,
+		TimeZone:    "UTC",
+		SocialLinks: map[string]string{},
+	}
+}
+
+// Location returns the time zone dates are shown in, or UTC if the zone
+// is unknown
+func (s *Settings) Location() *time.Location {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Validate normalizes the settings and checks them. It returns
+// ValidationErrors naming every invalid field, or nil.
+func (s *Settings) Validate() error {
+	var errs ValidationErrors
+
+	s.SiteName = normalizeText(s.SiteName, false)
+	s.Tagline = normalizeText(s.Tagline, false)
+
+	if utf8.RuneCountInString(s.SiteName) > MaxSiteNameLength {
+		errs.add("site_name", "site name must be at most %d characters", MaxSiteNameLength)
+	}
+	if utf8.RuneCountInString(s.Tagline) > MaxTaglineLength {
+		errs.add("tagline", "tagline must be at most %d characters", MaxTaglineLength)
+	}
+	if s.PageSize < 1 || s.PageSize > MaxPageSize {
+		errs.add("page_size", "page size must be between 1 and %d", MaxPageSize)
+	}
+	if _, err := time.LoadLocation(s.TimeZone); err != nil || s.TimeZone == "" {
+		errs.add("time_zone", "%q is not a time zone, e.g. Europe/Amsterdam", s.TimeZone)
+	}
+
+	for _, network := range SocialNetworks {
+		if link, ok := s.SocialLinks[network]; ok && !IsWebURL(link) {
+			errs.add("social_"+network, "the %s link must be an http or https URL", network)
+		}
+	}
+	for network := range s.SocialLinks {
+		if !isSocialNetwork(network) {
+			delete(s.SocialLinks, network)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SocialLink is a link to one of the site's social profiles
+type SocialLink struct {
+	Network string
+	URL     string
+}
+
+// Links returns the site's social links in the display order of
+// SocialNetworks
+func (s *Settings) Links() []SocialLink {
+	var links []SocialLink
+	for _, network := range SocialNetworks {
+		if link := s.SocialLinks[network]; link != "" {
+			links = append(links, SocialLink{Network: network, URL: link})
+		}
+	}
+	return links
+}
+
+// isSocialNetwork reports whether network is one of SocialNetworks
+func isSocialNetwork(network string) bool {
+	for _, n := range SocialNetworks {
+		if n == network {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSettings reads the settings table over the defaults. Unknown keys
+// are ignored, so removing a setting needs no migration.
+func GetSettings(ctx context.Context, db DBTX) (*Settings, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT name, value FROM settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		stored[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	settings := DefaultSettings()
+	for _, s := range settingKeys {
+		value, ok := stored[s.key]
+		if !ok {
+			continue
+		}
+		if err := decodeSetting(s.field(settings), value); err != nil {
+			return nil, fmt.Errorf("setting %s: %v", s.key, err)
+		}
+	}
+	return settings, nil
+}
+
+// SaveSettings stores every setting that differs from current and returns
+// the keys it changed
+func SaveSettings(ctx context.Context, db DBTX, current, settings *Settings, updatedBy string) ([]string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	var changed []string
+	for _, s := range settingKeys {
+		value, err := encodeSetting(s.field(settings))
+		if err != nil {
+			return changed, fmt.Errorf("setting %s: %v", s.key, err)
+		}
+		old, err := encodeSetting(s.field(current))
+		if err != nil {
+			return changed, fmt.Errorf("setting %s: %v", s.key, err)
+		}
+		if value == old {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO settings (name, value, updated_by, updated_at)
+			VALUES (?, ?, ?, UTC_TIMESTAMP())
+			ON DUPLICATE KEY UPDATE
+				value = VALUES(value),
+				updated_by = VALUES(updated_by),
+				updated_at = VALUES(updated_at)
+		`, s.key, value, updatedBy)
+		if err != nil {
+			return changed, err
+		}
+		changed = append(changed, s.key)
+	}
+	return changed, nil
+}
+
+// encodeSetting formats a setting field for the settings table
+func encodeSetting(field interface{}) (string, error) {
+	switch v := field.(type) {
+	case *string:
+		return *v, nil
+	case *int:
+		return strconv.Itoa(*v), nil
+	case *map[string]string:
+		data, err := json.Marshal(*v)
+		return string(data), err
+	default:
+		return "", fmt.Errorf("unsupported setting type %T", field)
+	}
+}
+
+// decodeSetting parses a value from the settings table into a setting field
+func decodeSetting(field interface{}, value string) error {
+	switch v := field.(type) {
+	case *string:
+		*v = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *map[string]string:
+		m := make(map[string]string)
+		if err := json.Unmarshal([]byte(value), &m); err != nil {
+			return err
+		}
+		*v = m
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return nil
+}
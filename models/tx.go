@@ -0,0 +1,105 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DBTX is what model functions need to run queries. Both *sql.DB and
+// *sql.Tx implement it, so a function can run on its own or as one step of
+// a transaction started with WithTx.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// queryTimeout limits how long a model function's queries may run, in
+// nanoseconds; 0 means no limit
+var queryTimeout atomic.Int64
+
+// SetQueryTimeout limits how long the queries of each model function may
+// run. The limit applies on top of the caller's context, so queries for a
+// request also stop when the client goes away. 0 removes the limit.
+func SetQueryTimeout(d time.Duration) {
+	queryTimeout.Store(int64(d))
+}
+
+// queryContext returns the context for the queries of a model function:
+// ctx limited by the query timeout. The caller must call cancel once its
+// rows are closed.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := time.Duration(queryTimeout.Load()); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// MySQL errors after which the whole transaction can simply be run again
+const (
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+)
+
+// txAttempts is how often WithTx runs a transaction that keeps hitting
+// deadlocks or lock wait timeouts
+const txAttempts = 3
+
+// txRetryDelay is the wait before the first retry; it doubles after each
+// attempt
+const txRetryDelay = 50 * time.Millisecond
+
+// WithTx runs fn in a transaction on db, committing if fn returns nil and
+// rolling back otherwise. If MySQL aborts the transaction because of a
+// deadlock or a lock wait timeout, fn is run again in a new transaction, so
+// it must not have effects outside the database that can't be repeated,
+// and must reset any fields of its records a failed attempt changed. If ctx
+// is cancelled the transaction is rolled back and not retried.
+func WithTx(ctx context.Context, db *sql.DB, fn func(tx DBTX) error) error {
+	delay := txRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, db, fn)
+		if err == nil || !retryableTxError(err) || attempt == txAttempts {
+			return err
+		}
+
+		log.Printf("Retrying transaction after attempt %d failed: %v", attempt, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// runTx runs fn in a single transaction
+func runTx(ctx context.Context, db *sql.DB, fn func(tx DBTX) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rolling back after a commit does nothing
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryableTxError reports whether err means MySQL gave up on the
+// transaction because of lock contention, so running it again may succeed
+func retryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == errDeadlock || mysqlErr.Number == errLockWaitTimeout
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// blockingDB is a DBTX whose queries run until their context is done, like
+// a query stuck behind a lock. A *sql.Row can't carry an error without a
+// real connection, so QueryRowContext fails the test instead.
+type blockingDB struct {
+	t *testing.T
+}
+
+func (blockingDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (db blockingDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	db.t.Helper()
+	db.t.Fatalf("blockingDB doesn't support QueryRowContext(%q)", query)
+	return nil
+}
+
+func TestQueryStopsWhenContextIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := ReleaseEditLock(ctx, blockingDB{t}, 1, "editor")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ReleaseEditLock() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestQueryStopsAtQueryTimeout(t *testing.T) {
+	SetQueryTimeout(20 * time.Millisecond)
+	defer SetQueryTimeout(0)
+
+	start := time.Now()
+	err := ReleaseEditLock(context.Background(), blockingDB{t}, 1, "editor")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReleaseEditLock() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReleaseEditLock() took %v, want about the 20ms timeout", elapsed)
+	}
+}
+
+// txConnector opens connections that only support empty transactions, for
+// running WithTx without a server
+type txConnector struct{}
+
+func (txConnector) Connect(context.Context) (driver.Conn, error) { return txConn{}, nil }
+func (txConnector) Driver() driver.Driver                        { return nil }
+
+type txConn struct{}
+
+func (txConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (txConn) Close() error                        { return nil }
+func (txConn) Begin() (driver.Tx, error)           { return txConn{}, nil }
+func (txConn) Commit() error                       { return nil }
+func (txConn) Rollback() error                     { return nil }
+
+var errDeadlockFound = &mysql.MySQLError{Number: errDeadlock, Message: "Deadlock found when trying to get lock"}
+
+func TestWithTxRetriesDeadlocks(t *testing.T) {
+	db := sql.OpenDB(txConnector{})
+	defer db.Close()
+
+	attempts := 0
+	err := WithTx(context.Background(), db, func(tx DBTX) error {
+		attempts++
+		if attempts < txAttempts {
+			return errDeadlockFound
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("WithTx() error = %v, want nil", err)
+	}
+	if attempts != txAttempts {
+		t.Errorf("fn ran %d times, want %d", attempts, txAttempts)
+	}
+}
+
+func TestWithTxStopsRetryingWhenContextIsDone(t *testing.T) {
+	db := sql.OpenDB(txConnector{})
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := 0
+	err := WithTx(ctx, db, func(tx DBTX) error {
+		attempts++
+		cancel()
+		return errDeadlockFound
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WithTx() error = %v, want %v", err, context.Canceled)
+	}
+	if attempts != 1 {
+		t.Errorf("fn ran %d times, want 1", attempts)
+	}
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Limits of the columns validated fields are stored in. VARCHAR lengths
+// count characters, TEXT counts bytes.
+const (
+	MaxTitleLength       = 255   // articles.title VARCHAR(255)
+	MaxImageURLLength    = 255   // articles.image_url VARCHAR(255)
+	MaxBylineLength      = 255   // articles.author VARCHAR(255)
+	MaxAuthorNameLength  = 100   // authors.name VARCHAR(100)
+	MaxDescriptionLength = 65535 // articles.description TEXT, in bytes
+	MaxDraftAuthorLength = 65535 // article_drafts.author TEXT, in bytes
+)
+
+// htmlTag matches anything that looks like an opening or closing HTML tag.
+// Text fields are plain text, so tags are refused rather than escaped into
+// visible markup.
+var htmlTag = regexp.MustCompile(`</?[a-zA-Z][^<>]*>`)
+
+// ValidationErrors lists every invalid field of a record
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the individual errors, so errors.As finds a
+// *ValidationError in ValidationErrors
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Fields maps each invalid field to its first error message
+func (e ValidationErrors) Fields() map[string]string {
+	fields := make(map[string]string, len(e))
+	for _, err := range e {
+		if _, ok := fields[err.Field]; !ok && err.Field != "" {
+			fields[err.Field] = err.Message
+		}
+	}
+	return fields
+}
+
+// add records a problem with field
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate normalizes the article's text fields and checks them against the
+// limits of the columns they are stored in. It returns ValidationErrors
+// naming every invalid field, or nil. Authors are checked by name, so it can
+// run before they are resolved to author records.
+func (a *Article) Validate() error {
+	var errs ValidationErrors
+
+	a.Title = normalizeText(a.Title, false)
+	a.Description = normalizeText(a.Description, true)
+	a.ImageURL = strings.TrimSpace(a.ImageURL)
+
+	switch {
+	case a.Title == "":
+		errs.add("title", "title is required")
+	case utf8.RuneCountInString(a.Title) > MaxTitleLength:
+		errs.add("title", "title must be at most %d characters", MaxTitleLength)
+	case htmlTag.MatchString(a.Title):
+		errs.add("title", "title must not contain HTML tags")
+	}
+
+	switch {
+	case a.Description == "":
+		errs.add("description", "content is required")
+	case len(a.Description) > MaxDescriptionLength:
+		errs.add("description", "content must be at most %d KB", MaxDescriptionLength>>10)
+	case htmlTag.MatchString(a.Description):
+		errs.add("description", "content must not contain HTML tags; use the media picker to add images")
+	}
+
+	var authors []Author
+	for _, author := range a.Authors {
+		if author.Name = NormalizeAuthorName(normalizeText(author.Name, false)); author.Name != "" {
+			authors = append(authors, author)
+		}
+	}
+	a.Authors = authors
+	names := a.AuthorNames()
+	a.Author = Byline(names)
+
+	switch {
+	case len(names) == 0:
+		errs.add("author", "at least one author is required")
+	case utf8.RuneCountInString(a.Author) > MaxBylineLength:
+		errs.add("author", "the byline must be at most %d characters", MaxBylineLength)
+	}
+	for _, name := range names {
+		if utf8.RuneCountInString(name) > MaxAuthorNameLength {
+			errs.add("author", "author names must be at most %d characters", MaxAuthorNameLength)
+		} else if htmlTag.MatchString(name) {
+			errs.add("author", "author names must not contain HTML tags")
+		}
+	}
+
+	if a.ImageURL != "" {
+		switch {
+		case utf8.RuneCountInString(a.ImageURL) > MaxImageURLLength:
+			errs.add("image_url", "image URL must be at most %d characters", MaxImageURLLength)
+		case !IsWebURL(a.ImageURL):
+			errs.add("image_url", "image URL must be an http or https URL")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks an autosave against the limits of the columns it is
+// stored in. Unlike an article, a draft may be incomplete, so only lengths
+// are checked; the text is normalized the same way.
+func (d *Draft) Validate() error {
+	var errs ValidationErrors
+
+	d.Title = normalizeText(d.Title, false)
+	d.Description = normalizeText(d.Description, true)
+	d.ImageURL = strings.TrimSpace(d.ImageURL)
+
+	if utf8.RuneCountInString(d.Title) > MaxTitleLength {
+		errs.add("title", "title must be at most %d characters", MaxTitleLength)
+	}
+	if len(d.Description) > MaxDescriptionLength {
+		errs.add("description", "content must be at most %d KB", MaxDescriptionLength>>10)
+	}
+	if utf8.RuneCountInString(d.ImageURL) > MaxImageURLLength {
+		errs.add("image_url", "image URL must be at most %d characters", MaxImageURLLength)
+	}
+	for _, name := range d.Authors {
+		if utf8.RuneCountInString(name) > MaxAuthorNameLength {
+			errs.add("author", "author names must be at most %d characters", MaxAuthorNameLength)
+			break
+		}
+	}
+	if len(strings.Join(d.Authors, "\n")) > MaxDraftAuthorLength {
+		errs.add("author", "too many authors")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// normalizeText replaces invalid UTF-8, composes characters (NFC, so "é"
+// typed as "e" and a combining accent counts as one character, as MySQL
+// stores it), unifies line endings, drops control and zero-width formatting
+// characters and trims surrounding whitespace. Single-line text also has
+// its line breaks and tabs turned into spaces.
+func normalizeText(s string, multiline bool) string {
+	s = norm.NFC.String(strings.ToValidUTF8(s, "\uFFFD"))
+	s = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(s)
+
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			if multiline {
+				return r
+			}
+			return ' '
+		case unicode.IsControl(r), r == '\uFEFF', r == '\u200B':
+			return -1
+		}
+		return r
+	}, s)
+
+	return strings.TrimSpace(s)
+}
+
+// IsWebURL reports whether s is an absolute http or https URL
+func IsWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTextComposesCharacters(t *testing.T) {
+	// "e" followed by a combining acute accent
+	decomposed := "Cafe\u0301"
+	if got := normalizeText(decomposed, false); got != "Caf\u00e9" {
+		t.Errorf("normalizeText(%q) = %q, want %q", decomposed, got, "Caf\u00e9")
+	}
+}
+
+func TestValidateCountsComposedCharacters(t *testing.T) {
+	// Each "é" is two code points before composition, so the title only
+	// fits the limit once composed
+	article := &Article{
+		Title:       strings.Repeat("e\u0301", MaxTitleLength),
+		Description: "Content",
+		Author:      "Jane Doe",
+	}
+	if err := article.Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+}
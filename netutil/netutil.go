@@ -0,0 +1,51 @@
+// Package netutil works out where a request came from when the server runs
+// behind reverse proxies. Forwarding headers are only believed when the
+// connection comes from one of the trusted proxies, since any other client
+// could set them to whatever it likes.
+package netutil
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// FromTrustedProxy reports whether r was made by one of proxies. Anyone
+// else could set forwarding headers themselves.
+func FromTrustedProxy(r *http.Request, proxies []netip.Prefix) bool {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, proxy := range proxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client making r. When r comes from
+// one of proxies, the address the proxy put in header is used; otherwise,
+// or if the header holds no address, it is the connection's address.
+func ClientIP(r *http.Request, header string, proxies []netip.Prefix) string {
+	if header != "" && FromTrustedProxy(r, proxies) {
+		// The proxy appends the address it saw to any the client sent, so
+		// only the last entry can be trusted
+		values := strings.Split(r.Header.Get(header), ",")
+		if ip, err := netip.ParseAddr(strings.TrimSpace(values[len(values)-1])); err == nil {
+			return ip.Unmap().String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return host
+}
@@ -0,0 +1,52 @@
+package netutil
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5123", "", "203.0.113.7"},
+		{"direct client spoofing the header", "203.0.113.7:5123", "198.51.100.1", "203.0.113.7"},
+		{"direct client spoofing a chain", "203.0.113.7:5123", "198.51.100.1, 198.51.100.2", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:443", "198.51.100.1", "198.51.100.1"},
+		{"trusted proxy appending to a spoofed entry", "10.1.2.3:443", "192.0.2.1, 198.51.100.1", "198.51.100.1"},
+		{"trusted proxy without the header", "10.1.2.3:443", "", "10.1.2.3"},
+		{"trusted proxy with a garbled header", "10.1.2.3:443", "unknown", "10.1.2.3"},
+		{"trusted proxy over IPv4-mapped IPv6", "[::ffff:10.1.2.3]:443", "198.51.100.1", "198.51.100.1"},
+		{"mapped client address", "[::ffff:203.0.113.7]:5123", "", "203.0.113.7"},
+		{"IPv6 client", "[2001:db8::1]:5123", "198.51.100.1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := ClientIP(r, "X-Forwarded-For", proxies); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutHeader(t *testing.T) {
+	// Without a configured header even a trusted proxy's value is ignored
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:443"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	if got := ClientIP(r, "", proxies); got != "10.1.2.3" {
+		t.Errorf("ClientIP() = %q, want %q", got, "10.1.2.3")
+	}
+}
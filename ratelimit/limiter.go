@@ -0,0 +1,205 @@
+// Package ratelimit throttles requests with token buckets. Users identified
+// through a trusted proxy get a bucket per user name, anonymous clients one
+// per IP address, so a newsroom behind a single NAT address doesn't share
+// one allowance. Buckets live in a Store: in memory for a single instance,
+// or in MySQL when several instances serve the same site.
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farrell_ivander/test-conn/auth"
+	"github.com/farrell_ivander/test-conn/config"
+	"github.com/farrell_ivander/test-conn/netutil"
+)
+
+// Class groups routes that share a rate limit
+type Class string
+
+const (
+	// Read covers pages, searches and the media picker
+	Read Class = "read"
+	// Write covers creating, updating, deleting and uploading
+	Write Class = "write"
+	// TestConnection covers database connection tests, which make the
+	// server connect to arbitrary hosts
+	TestConnection Class = "test-connection"
+)
+
+// Store keeps token buckets by key
+type Store interface {
+	// Take removes a token from the bucket named key, creating a full bucket
+	// on first use. If the bucket is empty it returns how long until a token
+	// is available instead.
+	Take(ctx context.Context, key string, rate config.Rate, now time.Time) (time.Duration, error)
+	// Prune forgets buckets last used before the given time
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// bucket is a token bucket holding up to rate.Count tokens, refilled evenly
+// over rate.Period
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time since it was last updated and
+// removes a token, or returns how long until one is available
+func (b *bucket) take(rate config.Rate, now time.Time) time.Duration {
+	perToken := rate.Period / time.Duration(rate.Count)
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(rate.Count), b.tokens+float64(elapsed)/float64(perToken))
+		b.updated = now
+	}
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return 0
+}
+
+// maxKeyLength is the longest bucket key, the width of the rate_limits
+// table's bucket_key column
+const maxKeyLength = 191
+
+// Limiter applies the configured rates to requests
+type Limiter struct {
+	store    Store
+	fallback *MemoryStore // Per-IP buckets used while store fails
+	rates    map[Class]config.Rate
+	ipHeader string
+	proxies  []netip.Prefix
+}
+
+// New returns a Limiter keeping its buckets in store. The client IP header
+// is only read from requests made by one of proxies.
+func New(store Store, cfg config.RateLimitConfig, proxies []netip.Prefix) *Limiter {
+	return &Limiter{
+		store:    store,
+		fallback: NewMemoryStore(),
+		rates: map[Class]config.Rate{
+			Read:           cfg.Read,
+			Write:          cfg.Write,
+			TestConnection: cfg.TestConnection,
+		},
+		ipHeader: cfg.ClientIPHeader,
+		proxies:  proxies,
+	}
+}
+
+// Limit wraps a handler so clients over the rate of the given class get
+// 429 Too Many Requests with a Retry-After header. If the store fails the
+// client's IP address is limited by this instance alone instead, since
+// refusing everyone would be worse and limiting no one would let a client
+// that breaks the store go unchecked.
+func (l *Limiter) Limit(class Class, next http.HandlerFunc) http.HandlerFunc {
+	rate := l.rates[class]
+	if rate.Count == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		key := bucketKey(class, l.clientKey(r))
+		wait, err := l.store.Take(r.Context(), key, rate, now)
+		if err != nil {
+			log.Printf("Rate limit check failed for %s, limiting by address on this instance: %v", key, err)
+			wait, _ = l.fallback.Take(r.Context(), bucketKey(class, "ip:"+l.clientIP(r)), rate, now)
+		}
+
+		if wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, fmt.Sprintf("Too many requests, try again in %d seconds", seconds), http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Limits returns Limit for class as middleware for a group of routes
+func (l *Limiter) Limits(class Class) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return l.Limit(class, next)
+	}
+}
+
+// clientKey identifies the client a request is counted against. The user
+// comes from auth, which only accepts names set by a trusted proxy, so a
+// client can't get a fresh bucket by sending a new name.
+func (l *Limiter) clientKey(r *http.Request) string {
+	if user := auth.FromContext(r.Context()); !user.Anonymous() {
+		return "user:" + hashKey(strings.ToLower(user.Name))
+	}
+	return "ip:" + l.clientIP(r)
+}
+
+// bucketKey names the bucket of a client for class. Keys too long for the
+// rate_limits table are hashed.
+func bucketKey(class Class, client string) string {
+	key := string(class) + ":" + client
+	if len(key) > maxKeyLength {
+		key = string(class) + ":" + hashKey(client)
+	}
+	return key
+}
+
+// hashKey returns a short, fixed-length stand-in for s
+func hashKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+// clientIP returns the address a client is counted by, its /64 for IPv6
+// since one host is usually given a whole /64
+func (l *Limiter) clientIP(r *http.Request) string {
+	addr := netutil.ClientIP(r, l.ipHeader, l.proxies)
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return addr
+	}
+	if ip.Is6() {
+		prefix, _ := ip.Prefix(64)
+		return prefix.String()
+	}
+	return addr
+}
+
+// PruneBuckets periodically forgets idle buckets until ctx is cancelled. A
+// bucket idle for the longest period is full again, so dropping it is
+// the same as keeping it.
+func (l *Limiter) PruneBuckets(ctx context.Context, interval time.Duration) {
+	var longest time.Duration
+	for _, rate := range l.rates {
+		if rate.Period > longest {
+			longest = rate.Period
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := l.store.Prune(ctx, now.Add(-longest)); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to prune rate limit buckets: %v", err)
+			}
+			l.fallback.Prune(ctx, now.Add(-longest))
+		}
+	}
+}
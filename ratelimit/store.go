@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/farrell_ivander/test-conn/config"
+)
+
+// MemoryStore keeps buckets in process memory. Each instance of the server
+// counts separately.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+// Take implements Store
+func (s *MemoryStore) Take(_ context.Context, key string, rate config.Rate, now time.Time) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Count), updated: now}
+		s.buckets[key] = b
+	}
+	return b.take(rate, now), nil
+}
+
+// Prune implements Store
+func (s *MemoryStore) Prune(_ context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		if b.updated.Before(before) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// MySQLStore keeps buckets in the rate_limits table so all instances share
+// them. Each Take locks the bucket's row for the duration of a short
+// transaction.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+// NewMySQLStore returns a MySQLStore using db, which must be the primary
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+// Take implements Store
+func (s *MySQLStore) Take(ctx context.Context, key string, rate config.Rate, now time.Time) (time.Duration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Create a full bucket on first use so there is a row to lock
+	_, err = tx.ExecContext(ctx,
+		"INSERT IGNORE INTO rate_limits (bucket_key, tokens, updated_at) VALUES (?, ?, ?)",
+		key, rate.Count, now)
+	if err != nil {
+		return 0, err
+	}
+
+	var b bucket
+	err = tx.QueryRowContext(ctx,
+		"SELECT tokens, updated_at FROM rate_limits WHERE bucket_key = ? FOR UPDATE",
+		key).Scan(&b.tokens, &b.updated)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := b.take(rate, now)
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE rate_limits SET tokens = ?, updated_at = ? WHERE bucket_key = ?",
+		b.tokens, b.updated, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return wait, tx.Commit()
+}
+
+// Prune implements Store
+func (s *MySQLStore) Prune(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE updated_at < ?", before)
+	return err
+}
@@ -0,0 +1,243 @@
+// Package remote fetches images from other sites on behalf of editors. All
+// requests go through a Fetcher that refuses to connect to private,
+// loopback and other internal addresses, so article image URLs can't be
+// used to reach services inside our network.
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/farrell_ivander/test-conn/config"
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+var (
+	// ErrBlockedAddress is returned for URLs that resolve to an internal address
+	ErrBlockedAddress = errors.New("address is not publicly routable")
+	// ErrTooLarge is returned for images over the configured size limit
+	ErrTooLarge = errors.New("image is too large")
+)
+
+// blockedPrefixes are special-purpose ranges that netip's predicates used
+// in allowedAddr don't cover
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, can reach internal IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/32"),       // Teredo, can embed internal IPv4
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, can embed internal IPv4
+	netip.MustParsePrefix("fec0::/10"),       // deprecated site-local
+}
+
+// allowedAddr reports whether a resolved address may be connected to.
+// Loopback, link-local (including cloud metadata at 169.254.169.254),
+// multicast and private ranges are never global unicast.
+func allowedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Image is an image downloaded from a remote URL
+type Image struct {
+	Data        []byte
+	ContentType string
+	FileName    string
+	URL         string // Final URL after redirects
+}
+
+// Fetcher downloads remote images with SSRF protection, size and type
+// limits, a timeout and a bounded number of redirects
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int
+
+	// allowAddr decides which resolved addresses may be connected to;
+	// tests replace it to reach servers on the loopback interface
+	allowAddr func(netip.Addr) bool
+}
+
+// NewFetcher returns a Fetcher for the given settings
+func NewFetcher(cfg config.MediaConfig) *Fetcher {
+	f := &Fetcher{maxBytes: cfg.FetchMaxBytes, allowAddr: allowedAddr}
+	if cfg.FetchAllowPrivate {
+		f.allowAddr = func(netip.Addr) bool { return true }
+	}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.FetchTimeout,
+		// Control runs after DNS resolution for every address tried, so a
+		// host name can't sneak past the check by resolving differently
+		// later (DNS rebinding)
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !f.allowAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// Never use an environment proxy: it would make the connection on
+		// our behalf and bypass the address check
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.FetchTimeout,
+		ResponseHeaderTimeout: cfg.FetchTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	maxRedirects := cfg.FetchMaxRedirects
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.FetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return checkURL(req.URL)
+		},
+	}
+
+	return f
+}
+
+// checkURL rejects URLs that aren't plain http or https
+func checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	if u.User != nil {
+		return errors.New("URLs with credentials are not allowed")
+	}
+	return nil
+}
+
+// get requests rawURL and returns the response if it succeeded
+func (f *Fetcher) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	if err := checkURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "image/jpeg, image/png, image/gif, image/webp")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote server returned %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// Fetch downloads the image at rawURL
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Image, error) {
+	resp, err := f.get(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > int64(f.maxBytes) {
+		return nil, ErrTooLarge
+	}
+
+	// Read one byte more than allowed to detect oversized bodies without a
+	// Content-Length
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(f.maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > f.maxBytes {
+		return nil, ErrTooLarge
+	}
+
+	// The type is detected from the content rather than the Content-Type
+	// header, and may have a lower size limit than the fetch limit
+	contentType, err := models.CheckImage(data, f.maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Image{
+		Data:        data,
+		ContentType: contentType,
+		FileName:    fileName(resp.Request.URL, contentType),
+		URL:         resp.Request.URL.String(),
+	}, nil
+}
+
+// Check verifies that rawURL still serves a supported image, reading only
+// enough of it to detect the type
+func (f *Fetcher) Check(ctx context.Context, rawURL string) error {
+	resp, err := f.get(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	_, err = models.DetectImageType(head[:n])
+	return err
+}
+
+// fileName derives a library file name from the image URL
+func fileName(u *url.URL, contentType string) string {
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = u.Hostname()
+	}
+	return models.ImageFileName(name, contentType)
+}
@@ -0,0 +1,191 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/farrell_ivander/test-conn/config"
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+// pngImage is the PNG signature followed by filler, enough for content
+// sniffing to report image/png
+var pngImage = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 56)...)
+
+// testFetcher returns a Fetcher that may connect to loopback servers
+// started by httptest, but still refuses every other internal address
+func testFetcher(maxBytes, maxRedirects int) *Fetcher {
+	f := NewFetcher(config.MediaConfig{
+		FetchTimeout:      5 * time.Second,
+		FetchMaxBytes:     maxBytes,
+		FetchMaxRedirects: maxRedirects,
+	})
+	f.allowAddr = func(addr netip.Addr) bool {
+		return addr.IsLoopback() || allowedAddr(addr)
+	}
+	return f
+}
+
+func TestFetchImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngImage)
+	}))
+	defer server.Close()
+
+	image, err := testFetcher(1024, 3).Fetch(context.Background(), server.URL+"/photos/cat.png")
+	if err != nil {
+		t.Fatalf("Fetch() error: %v", err)
+	}
+	if image.ContentType != "image/png" {
+		t.Errorf("ContentType = %q, want image/png", image.ContentType)
+	}
+	if image.FileName != "cat.png" {
+		t.Errorf("FileName = %q, want cat.png", image.FileName)
+	}
+	if !bytes.Equal(image.Data, pngImage) {
+		t.Errorf("Data has %d bytes, want the %d served", len(image.Data), len(pngImage))
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	large := append(append([]byte{}, pngImage...), bytes.Repeat([]byte{0}, 2048)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Query().Get("length") != "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+		} else {
+			// Flushing first makes the response chunked, without a length
+			w.(http.Flusher).Flush()
+		}
+		w.Write(large)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"with content length", server.URL + "/?length=1"},
+		{"without content length", server.URL + "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testFetcher(1024, 3).Fetch(context.Background(), tt.url)
+			if !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Fetch() error = %v, want %v", err, ErrTooLarge)
+			}
+		})
+	}
+}
+
+func TestFetchRejectsNonImages(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"html", "text/html", "<html><body>Not an image</body></html>"},
+		{"html claiming to be an image", "image/png", "<html><body>Not an image</body></html>"},
+		{"svg", "image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := testFetcher(1024, 3).Fetch(context.Background(), server.URL)
+			if !errors.Is(err, models.ErrUnsupportedImage) {
+				t.Errorf("Fetch() error = %v, want %v", err, models.ErrUnsupportedImage)
+			}
+		})
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	// /hops/n redirects n more times before serving the image
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+		if hops > 0 {
+			http.Redirect(w, r, "/hops/"+strconv.Itoa(hops-1), http.StatusFound)
+			return
+		}
+		w.Write(pngImage)
+	}))
+	defer server.Close()
+
+	f := testFetcher(1024, 2)
+	image, err := f.Fetch(context.Background(), server.URL+"/hops/2")
+	if err != nil {
+		t.Fatalf("Fetch() with 2 redirects error: %v", err)
+	}
+	if want := server.URL + "/hops/0"; image.URL != want {
+		t.Errorf("URL = %q, want %q", image.URL, want)
+	}
+
+	_, err = f.Fetch(context.Background(), server.URL+"/hops/3")
+	if err == nil || !strings.Contains(err.Error(), "stopped after 2 redirects") {
+		t.Errorf("Fetch() with 3 redirects error = %v, want the redirect limit", err)
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			http.Redirect(w, r, "http://10.0.0.1/secret.png", http.StatusFound)
+			return
+		}
+		w.Write(pngImage)
+	}))
+	defer server.Close()
+
+	// Without the test hook loopback is as internal as anything else
+	f := NewFetcher(config.MediaConfig{FetchTimeout: 5 * time.Second, FetchMaxBytes: 1024, FetchMaxRedirects: 3})
+	if _, err := f.Fetch(context.Background(), server.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Fetch() of a loopback server error = %v, want %v", err, ErrBlockedAddress)
+	}
+
+	// A public server can't redirect to an internal one
+	_, err := testFetcher(1024, 3).Fetch(context.Background(), server.URL+"/internal")
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Fetch() redirected to a private address error = %v, want %v", err, ErrBlockedAddress)
+	}
+}
+
+func TestAllowedAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+	for _, tt := range tests {
+		if got := allowedAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("allowedAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package remote
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+// MonitorImages checks every hot-linked article image once per interval
+// and records which ones are broken, until ctx is cancelled. The first
+// pass runs immediately.
+func (f *Fetcher) MonitorImages(ctx context.Context, db *sql.DB, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		f.checkImages(ctx, db)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkImages runs one pass over the hot-linked article images
+func (f *Fetcher) checkImages(ctx context.Context, db *sql.DB) {
+	urls, err := models.GetExternalImageURLs(ctx, db)
+	if err != nil {
+		log.Printf("Failed to list external images: %v", err)
+		return
+	}
+
+	broken := 0
+	for _, url := range urls {
+		if ctx.Err() != nil {
+			return
+		}
+
+		check := &models.ImageCheck{URL: url, OK: true, CheckedAt: time.Now().UTC().Truncate(time.Second)}
+		if err := f.Check(ctx, url); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			check.OK = false
+			check.Error = err.Error()
+			broken++
+		}
+
+		if err := models.SaveImageCheck(ctx, db, check); err != nil {
+			log.Printf("Failed to save image check for %s: %v", url, err)
+		}
+	}
+
+	if err := models.PruneImageChecks(ctx, db); err != nil {
+		log.Printf("Failed to prune image checks: %v", err)
+	}
+
+	if broken > 0 {
+		log.Printf("Checked %d external images, %d broken", len(urls), broken)
+	}
+}
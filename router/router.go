@@ -0,0 +1,183 @@
+// Package router registers routes on a Go 1.22 ServeMux by method and path
+// pattern, with path parameters read through r.PathValue. The mux answers
+// 405 with an Allow header when a path matches but the method doesn't.
+// Routes can be grouped under a path prefix and middleware, and named
+// routes can be turned back into URLs for redirects and templates.
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Middleware wraps a handler, e.g. to check permissions or rate limits
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Router registers routes. Groups share the mux and route names of the
+// router they were created from.
+type Router struct {
+	mux        *http.ServeMux
+	names      map[string]string // Route name to path pattern
+	prefix     string
+	middleware []Middleware
+	notFound   http.HandlerFunc
+}
+
+// New returns an empty Router
+func New() *Router {
+	return &Router{
+		mux:   http.NewServeMux(),
+		names: make(map[string]string),
+	}
+}
+
+// Group returns a router whose routes are registered under prefix and
+// wrapped in middleware, after the middleware of rt. The first middleware
+// runs first.
+func (rt *Router) Group(prefix string, middleware ...Middleware) *Router {
+	return &Router{
+		mux:        rt.mux,
+		names:      rt.names,
+		prefix:     rt.prefix + prefix,
+		middleware: append(append([]Middleware(nil), rt.middleware...), middleware...),
+	}
+}
+
+// Handle registers handler for method and path, which may contain
+// {parameters}. A non-empty name makes the route available to URL.
+func (rt *Router) Handle(method, path, name string, handler http.HandlerFunc) {
+	pattern := rt.prefix + path
+	if name != "" {
+		if _, ok := rt.names[name]; ok {
+			panic("router: duplicate route name " + name)
+		}
+		rt.names[name] = pattern
+	}
+
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		handler = rt.middleware[i](handler)
+	}
+	rt.mux.HandleFunc(method+" "+pattern, handler)
+}
+
+// Get registers a GET route, which also answers HEAD
+func (rt *Router) Get(path, name string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodGet, path, name, handler)
+}
+
+// Post registers a POST route
+func (rt *Router) Post(path, name string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodPost, path, name, handler)
+}
+
+// Delete registers a DELETE route
+func (rt *Router) Delete(path, name string, handler http.HandlerFunc) {
+	rt.Handle(http.MethodDelete, path, name, handler)
+}
+
+// Mount serves every GET request under the path prefix with handler,
+// e.g. a file server. The group's middleware is not applied.
+func (rt *Router) Mount(prefix string, handler http.Handler) {
+	rt.mux.Handle(http.MethodGet+" "+rt.prefix+prefix, handler)
+}
+
+// NotFound sets the handler for requests that match no route. Requests for
+// a known path with the wrong method still get 405 from the mux.
+func (rt *Router) NotFound(handler http.HandlerFunc) {
+	rt.notFound = handler
+}
+
+// ServeHTTP dispatches the request to the matching route
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.notFound == nil {
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	// The mux only sets path values when it serves the request itself, so
+	// it is asked for the pattern first and then left to dispatch
+	if _, pattern := rt.mux.Handler(r); pattern != "" {
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	// No route matched. The mux either answers 404 or 405 with an Allow
+	// header, so let it respond and replace only a 404.
+	nw := &notFoundWriter{ResponseWriter: w}
+	rt.mux.ServeHTTP(nw, r)
+	if nw.notFound {
+		w.Header().Del("Content-Type")
+		w.Header().Del("X-Content-Type-Options")
+		rt.notFound(w, r)
+	}
+}
+
+// notFoundWriter swallows a 404 response so a custom one can be written
+type notFoundWriter struct {
+	http.ResponseWriter
+	notFound bool
+}
+
+func (w *notFoundWriter) WriteHeader(code int) {
+	if code == http.StatusNotFound {
+		w.notFound = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *notFoundWriter) Write(b []byte) (int, error) {
+	if w.notFound {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// URL builds the path of a named route, filling in its parameters in order
+func (rt *Router) URL(name string, params ...interface{}) (string, error) {
+	pattern, ok := rt.names[name]
+	if !ok {
+		return "", fmt.Errorf("router: no route named %q", name)
+	}
+
+	segments := strings.Split(pattern, "/")
+	used := 0
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") {
+			continue
+		}
+		if segment == "{$}" {
+			segments[i] = ""
+			continue
+		}
+		if used == len(params) {
+			return "", fmt.Errorf("router: route %q needs more than %d parameters", name, len(params))
+		}
+
+		value := fmt.Sprint(params[used])
+		if strings.HasSuffix(segment, "...}") {
+			// A trailing wildcard keeps its slashes
+			segments[i] = (&url.URL{Path: value}).EscapedPath()
+		} else {
+			segments[i] = url.PathEscape(value)
+		}
+		used++
+	}
+	if used != len(params) {
+		return "", fmt.Errorf("router: route %q takes %d parameters, got %d", name, used, len(params))
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// MustURL is like URL but panics if the route doesn't exist or the
+// parameters don't fit, which is always a programming error
+func (rt *Router) MustURL(name string, params ...interface{}) string {
+	u, err := rt.URL(name, params...)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
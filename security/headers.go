@@ -0,0 +1,119 @@
+// Package security adds browser security headers to every response: a
+// Content Security Policy with a per-request nonce for the inline scripts in
+// our templates, HSTS, framing, referrer and permissions policies. CSP
+// violations reported by browsers are logged by ReportHandler.
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/farrell_ivander/test-conn/config"
+	"github.com/farrell_ivander/test-conn/netutil"
+)
+
+// NoncePlaceholder is replaced with the request's nonce in CSP policies
+const NoncePlaceholder = "{nonce}"
+
+// ReportPath is where browsers send CSP violation reports
+const ReportPath = "/csp-report"
+
+type contextKey struct{}
+
+// Headers adds the configured security headers to responses
+type Headers struct {
+	cfg     config.SecurityConfig
+	proxies []netip.Prefix
+}
+
+// New returns Headers for the given settings. X-Forwarded-Proto is only
+// read from requests made by one of proxies.
+func New(cfg config.SecurityConfig, proxies []netip.Prefix) *Headers {
+	return &Headers{cfg: cfg, proxies: proxies}
+}
+
+// Middleware sets the security headers before calling next, so handlers can
+// still override them for their own responses. The request context carries
+// the nonce for Nonce.
+func (s *Headers) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := newNonce()
+		if err != nil {
+			http.Error(w, "Failed to generate nonce", http.StatusInternalServerError)
+			return
+		}
+
+		header := w.Header()
+		if policy := s.policy(r.URL.Path); policy != "" {
+			name := "Content-Security-Policy"
+			if s.cfg.CSPReportOnly {
+				name = "Content-Security-Policy-Report-Only"
+			}
+			header.Set(name, strings.ReplaceAll(policy, NoncePlaceholder, nonce))
+		}
+
+		// Browsers ignore HSTS over plain HTTP, and setting it on a
+		// development server would pin localhost to HTTPS
+		if s.cfg.HSTSMaxAge > 0 && s.isTLS(r) {
+			header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(s.cfg.HSTSMaxAge.Seconds()))+"; includeSubDomains")
+		}
+
+		header.Set("X-Content-Type-Options", "nosniff")
+		if s.cfg.FrameOptions != "" {
+			header.Set("X-Frame-Options", s.cfg.FrameOptions)
+		}
+		if s.cfg.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", s.cfg.ReferrerPolicy)
+		}
+		if s.cfg.PermissionsPolicy != "" {
+			header.Set("Permissions-Policy", s.cfg.PermissionsPolicy)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, nonce)))
+	})
+}
+
+// policy returns the CSP for a path: the route policy with the longest
+// matching path prefix, or else the default policy. An empty route policy
+// turns CSP off for that route.
+func (s *Headers) policy(path string) string {
+	policy := s.cfg.CSP
+	longest := -1
+	for prefix, routePolicy := range s.cfg.RouteCSP {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			policy = routePolicy
+			longest = len(prefix)
+		}
+	}
+	return policy
+}
+
+// Nonce returns the CSP nonce of the request, for the nonce attribute of
+// inline <script> elements
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(contextKey{}).(string)
+	return nonce
+}
+
+// newNonce returns 128 random bits, base64 encoded
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// isTLS reports whether the client connected over HTTPS, either directly or
+// through a trusted proxy
+func (s *Headers) isTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return netutil.FromTrustedProxy(r, s.proxies) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
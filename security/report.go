@@ -0,0 +1,90 @@
+package security
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// maxReportSize caps the size of a violation report body
+const maxReportSize = 64 << 10
+
+// violation holds the fields of a CSP violation we log. Browsers send either
+// the legacy report-uri format with dashed names or the Reporting API
+// format with camelCase names, so both are decoded.
+type violation struct {
+	DocumentURI        string `json:"document-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+	Disposition        string `json:"disposition"`
+
+	DocumentURL             string `json:"documentURL"`
+	EffectiveDirectiveCamel string `json:"effectiveDirective"`
+	BlockedURL              string `json:"blockedURL"`
+	SourceFileCamel         string `json:"sourceFile"`
+	LineNumberCamel         int    `json:"lineNumber"`
+}
+
+// log writes the violation to the server log
+func (v *violation) log() {
+	document, directive, blocked, source, line := v.DocumentURI, v.EffectiveDirective, v.BlockedURI, v.SourceFile, v.LineNumber
+	if document == "" {
+		document, directive, blocked, source, line = v.DocumentURL, v.EffectiveDirectiveCamel, v.BlockedURL, v.SourceFileCamel, v.LineNumberCamel
+	}
+	if directive == "" {
+		directive = v.ViolatedDirective
+	}
+	if v.Disposition == "report" {
+		directive += " (report only)"
+	}
+	log.Printf("CSP violation on %s: %s blocked %q at %s:%d", document, directive, blocked, source, line)
+}
+
+// ReportHandler logs the CSP violation reports sent by browsers
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxReportSize))
+	if err != nil {
+		http.Error(w, "Report too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var violations []violation
+	switch r.Header.Get("Content-Type") {
+	case "application/reports+json":
+		// Reporting API: a batch of reports of any type
+		var reports []struct {
+			Type string    `json:"type"`
+			Body violation `json:"body"`
+		}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			http.Error(w, "Invalid report", http.StatusBadRequest)
+			return
+		}
+		for _, report := range reports {
+			if report.Type == "csp-violation" {
+				violations = append(violations, report.Body)
+			}
+		}
+
+	default:
+		// report-uri: a single report wrapped in "csp-report"
+		var report struct {
+			Violation violation `json:"csp-report"`
+		}
+		if err := json.Unmarshal(body, &report); err != nil {
+			http.Error(w, "Invalid report", http.StatusBadRequest)
+			return
+		}
+		violations = append(violations, report.Violation)
+	}
+
+	for i := range violations {
+		violations[i].log()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,124 @@
+// Package settings keeps the site settings in memory, so every page can
+// show them without a query. Settings are read again after a short while,
+// so a change saved through one instance reaches the others.
+package settings
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/farrell_ivander/test-conn/models"
+)
+
+// refreshInterval is how long cached settings are used before they are
+// read again
+const refreshInterval = 30 * time.Second
+
+// Service caches the settings stored in the database
+type Service struct {
+	db *sql.DB
+
+	saveMu sync.Mutex // Held by Update, so saves don't interleave
+
+	mu         sync.Mutex
+	current    *models.Settings
+	generation int // Incremented whenever current is replaced
+	expires    time.Time
+	refreshing bool
+	onChange   []func(*models.Settings)
+}
+
+// New returns a Service reading and saving settings in db, which should be
+// the primary so saved changes are read back at once
+func New(db *sql.DB) *Service {
+	return &Service{db: db, current: models.DefaultSettings()}
+}
+
+// OnChange registers fn to be called with the settings whenever they are
+// read or saved, e.g. to apply the time zone
+func (s *Service) OnChange(fn func(*models.Settings)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+// Get returns the settings, reading them again if the cached ones are
+// older than refreshInterval. Only one caller reads them; the others get
+// the cached settings meanwhile instead of waiting for the database. If
+// reading fails the last known settings are used, e.g. when ctx is
+// cancelled. The result is shared and must not be modified.
+func (s *Service) Get(ctx context.Context) *models.Settings {
+	s.mu.Lock()
+	if s.refreshing || time.Now().Before(s.expires) {
+		defer s.mu.Unlock()
+		return s.current
+	}
+	s.refreshing = true
+	generation := s.generation
+	s.mu.Unlock()
+
+	settings, err := models.GetSettings(ctx, s.db)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshing = false
+	s.expires = time.Now().Add(refreshInterval)
+	if err != nil {
+		log.Printf("Failed to load settings: %v", err)
+		return s.current
+	}
+	// Settings saved while reading are newer than the ones read
+	if s.generation == generation {
+		s.set(settings)
+	}
+	return s.current
+}
+
+// Update validates settings and saves the ones that changed, recording
+// updatedBy as their author. If any changed, record is called in the same
+// transaction with the settings as they were before, read from the
+// database so changes saved elsewhere aren't reverted unnoticed; if it
+// fails nothing is saved.
+func (s *Service) Update(ctx context.Context, settings *models.Settings, updatedBy string, record func(tx models.DBTX, before *models.Settings) error) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	// Either every changed setting is saved, and recorded, or none is
+	err := models.WithTx(ctx, s.db, func(tx models.DBTX) error {
+		before, err := models.GetSettings(ctx, tx)
+		if err != nil {
+			return err
+		}
+		changed, err := models.SaveSettings(ctx, tx, before, settings, updatedBy)
+		if err != nil || len(changed) == 0 {
+			return err
+		}
+		return record(tx, before)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(settings)
+	s.expires = time.Now().Add(refreshInterval)
+	return nil
+}
+
+// set replaces the cached settings and tells the OnChange functions. The
+// caller must hold s.mu.
+func (s *Service) set(settings *models.Settings) {
+	s.current = settings
+	s.generation++
+	for _, fn := range s.onChange {
+		fn(settings)
+	}
+}
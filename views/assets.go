@@ -0,0 +1,117 @@
+package views
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// immutable lets browsers keep a fingerprinted file for a year without
+// checking back, since any change to it gives it a new name
+const immutable = "public, max-age=31536000, immutable"
+
+// Assets serves static files under fingerprinted names such as
+// styles.3f2a9c1b0d.css, which change whenever the file does. Pages link to
+// them with the asset template function, e.g. {{asset "styles.css"}}.
+// Files requested by their plain name are still served, but browsers have
+// to revalidate them.
+type Assets struct {
+	fsys        fs.FS
+	prefix      string // URL path the files are served under
+	fingerprint bool
+	names       map[string]string // File name to fingerprinted name
+	files       map[string]string // Fingerprinted name to file name
+	fallback    http.Handler
+}
+
+// NewAssets fingerprints the files of fsys, to be served under prefix, e.g.
+// "/static/". Without fingerprint, as in dev mode, links use the plain file
+// names so edited files show up on the next page load.
+func NewAssets(fsys fs.FS, prefix string, fingerprint bool) (*Assets, error) {
+	a := &Assets{
+		fsys:        fsys,
+		prefix:      prefix,
+		fingerprint: fingerprint,
+		names:       make(map[string]string),
+		files:       make(map[string]string),
+		fallback:    noDirectories(fsys, http.FileServerFS(fsys)),
+	}
+	if !fingerprint {
+		return a, nil
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		ext := path.Ext(name)
+		hashed := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:5]) + ext
+		a.names[name] = hashed
+		a.files[hashed] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Path returns the URL of a static file for the asset template function.
+// Unknown files are an error so a mistyped name fails the page instead of
+// producing a broken link.
+func (a *Assets) Path(name string) (string, error) {
+	if a.fingerprint {
+		if hashed, ok := a.names[name]; ok {
+			return a.prefix + hashed, nil
+		}
+	} else if _, err := fs.Stat(a.fsys, name); err == nil {
+		return a.prefix + name, nil
+	}
+	return "", fmt.Errorf("views: no static file %q", name)
+}
+
+// ServeHTTP serves a static file by its fingerprinted or plain name. The
+// request path must already have the prefix stripped.
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.files[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		w.Header().Set("Cache-Control", "no-cache")
+		a.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", immutable)
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + name
+	a.fallback.ServeHTTP(w, r2)
+}
+
+// noDirectories serves files with next but answers requests for directories
+// with 404 Not Found, so their contents aren't listed
+func noDirectories(fsys fs.FS, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = "."
+		}
+		if info, err := fs.Stat(fsys, name); err == nil && info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
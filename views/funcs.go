@@ -0,0 +1,50 @@
+package views
+
+import (
+	"html/template"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// helpers returns the functions available to every template. They take
+// the piped value last, e.g. {{.CreatedAt | date "Jan 02, 2006"}} or
+// {{.PlainText | truncate 150}}.
+func (r *Renderer) helpers() template.FuncMap {
+	return template.FuncMap{
+		"date":     r.date,
+		"truncate": truncate,
+	}
+}
+
+// SetLocation sets the time zone the date helper shows times in
+func (r *Renderer) SetLocation(loc *time.Location) {
+	r.location.Store(loc)
+}
+
+// date formats t in the renderer's time zone with a time.Format layout.
+// The zero time, such as a missing timestamp, formats as an empty string.
+func (r *Renderer) date(layout string, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	if loc := r.location.Load(); loc != nil {
+		t = t.In(loc)
+	}
+	return t.Format(layout)
+}
+
+// truncate shortens s to at most n characters, cutting at the last word
+// boundary and adding an ellipsis if anything was cut
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	runes := []rune(s)
+	cut := string(runes[:n])
+	if i := strings.LastIndexAny(cut, " \n\t"); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " \n\t.,;:") + "..."
+}
@@ -0,0 +1,58 @@
+package views
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+)
+
+// overlay is a file system whose files come from upper where it has them
+// and from lower otherwise
+type overlay struct {
+	upper, lower fs.FS
+}
+
+// Overlay returns a file system that reads files from upper and falls back
+// to lower for the ones upper doesn't have. Directory listings merge both,
+// so an override directory only needs the files it changes.
+func Overlay(upper, lower fs.FS) fs.FS {
+	return overlay{upper: upper, lower: lower}
+}
+
+func (o overlay) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	return o.lower.Open(name)
+}
+
+// ReadDir lists a directory of either file system. Entries of upper replace
+// those of lower with the same name.
+func (o overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, err := fs.ReadDir(o.upper, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	upperErr := err
+
+	lower, err := fs.ReadDir(o.lower, name)
+	if err != nil && (upperErr != nil || !errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	}
+
+	entries := make(map[string]fs.DirEntry, len(upper)+len(lower))
+	for _, entry := range lower {
+		entries[entry.Name()] = entry
+	}
+	for _, entry := range upper {
+		entries[entry.Name()] = entry
+	}
+
+	merged := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		merged = append(merged, entry)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+	return merged, nil
+}
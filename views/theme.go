@@ -0,0 +1,119 @@
+package views
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// manifest is the file describing a theme, at the root of its directory
+const manifest = "theme.json"
+
+var (
+	// colorName matches the names of theme colors, which set the CSS
+	// custom property --<name>-color
+	colorName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+	// colorValue matches hex colors, color keywords and rgb() or hsl()
+	// colors, so a manifest can't inject other CSS
+	colorValue = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+|(rgb|rgba|hsl|hsla)\([0-9.,%\s]+\))$`)
+)
+
+// Theme holds the settings of a theme from its theme.json manifest. Pages
+// get the current theme as .Theme.
+type Theme struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	SiteName    string            `json:"site_name"`
+	Logo        string            `json:"logo"`   // Static file name, e.g. "logo.svg"
+	Colors      map[string]string `json:"colors"` // By name, e.g. "primary": "#0069ff"
+}
+
+// Stylesheet returns CSS setting the theme's colors as the custom
+// properties the stylesheet uses, e.g. --primary-color. The colors were
+// checked when the theme was loaded, so the CSS is safe to inline.
+func (t *Theme) Stylesheet() template.CSS {
+	if len(t.Colors) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(t.Colors))
+	for name := range t.Colors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(":root {")
+	for _, name := range names {
+		fmt.Fprintf(&b, " --%s-color: %s;", name, t.Colors[name])
+	}
+	b.WriteString(" }")
+	return template.CSS(b.String())
+}
+
+// loadTheme reads the theme manifest of fsys. In an Overlay the manifest
+// of the upper file system is applied over that of the lower one, so a
+// theme only needs the settings it changes.
+func loadTheme(fsys fs.FS) (*Theme, error) {
+	theme := &Theme{Colors: make(map[string]string)}
+	if err := readManifest(fsys, theme); err != nil {
+		return nil, err
+	}
+	if err := theme.validate(fsys); err != nil {
+		return nil, fmt.Errorf("%s: %v", manifest, err)
+	}
+	return theme, nil
+}
+
+// readManifest decodes the manifests of fsys into theme, the lowest layer
+// of an Overlay first. A missing manifest leaves theme unchanged.
+func readManifest(fsys fs.FS, theme *Theme) error {
+	if o, ok := fsys.(overlay); ok {
+		if err := readManifest(o.lower, theme); err != nil {
+			return err
+		}
+		return readManifest(o.upper, theme)
+	}
+
+	data, err := fs.ReadFile(fsys, manifest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, theme); err != nil {
+		return fmt.Errorf("%s: %v", manifest, err)
+	}
+	return nil
+}
+
+// validate checks the colors and that the logo is one of the static files
+func (t *Theme) validate(fsys fs.FS) error {
+	var errs []error
+	for name, value := range t.Colors {
+		if !colorName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("color name %q must be lowercase letters, digits and dashes", name))
+		}
+		if !colorValue.MatchString(value) {
+			errs = append(errs, fmt.Errorf("color %s: %q is not a hex, named, rgb() or hsl() color", name, value))
+		}
+	}
+
+	if t.Logo != "" {
+		if !fs.ValidPath(t.Logo) {
+			errs = append(errs, fmt.Errorf("logo %q must be a file name in static/", t.Logo))
+		} else if _, err := fs.Stat(fsys, path.Join("static", t.Logo)); err != nil {
+			errs = append(errs, fmt.Errorf("logo: %v", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,169 @@
+// Package views renders the HTML pages. Every page in the templates
+// directory fills in the blocks of the base layout in templates/layouts and
+// may use the partials in templates/partials, and gets the settings of the
+// theme from theme.json as .Theme. Pages are parsed up front so template
+// errors stop the server at startup.
+package views
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dir is the directory of fsys the templates are read from
+const dir = "templates"
+
+// Renderer renders pages parsed from the templates directory of a file
+// system
+type Renderer struct {
+	fsys     fs.FS
+	funcs    template.FuncMap
+	reload   bool
+	location atomic.Pointer[time.Location] // Of the date helper; nil keeps times as they are
+
+	mu      sync.Mutex
+	pages   map[string]*template.Template // By file name, e.g. "index.html"
+	theme   *Theme
+	version string // Fingerprint of the files pages were parsed from
+}
+
+// New parses the templates and theme manifest in fsys. funcs are added to
+// the built-in helpers, date and truncate. With reload set, both are read
+// again whenever one of the files changes, for editing them while the
+// server runs.
+func New(fsys fs.FS, funcs template.FuncMap, reload bool) (*Renderer, error) {
+	r := &Renderer{fsys: fsys, funcs: funcs, reload: reload}
+
+	var err error
+	if r.version, err = r.fingerprint(); err != nil {
+		return nil, err
+	}
+	if r.pages, err = r.parse(); err != nil {
+		return nil, err
+	}
+	if r.theme, err = loadTheme(fsys); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Render executes the page with the given file name, with the theme added
+// to data as .Theme, and writes it to w. A failure can leave a partial page
+// in w, so HTTP handlers should render into a buffer and only send it once
+// Render succeeds.
+func (r *Renderer) Render(w io.Writer, name string, data map[string]interface{}) error {
+	pages, theme, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	page, ok := pages[name]
+	if !ok {
+		return fmt.Errorf("views: no page %q", name)
+	}
+
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["Theme"] = theme
+	return page.ExecuteTemplate(w, "base", data)
+}
+
+// load returns the parsed pages and theme, reading them again first if
+// reloading is enabled and the files changed
+func (r *Renderer) load() (map[string]*template.Template, *Theme, error) {
+	if !r.reload {
+		return r.pages, r.theme, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	version, err := r.fingerprint()
+	if err != nil {
+		return nil, nil, err
+	}
+	if version == r.version {
+		return r.pages, r.theme, nil
+	}
+
+	pages, err := r.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	theme, err := loadTheme(r.fsys)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.pages, r.theme, r.version = pages, theme, version
+	log.Println("Reloaded templates")
+	return pages, theme, nil
+}
+
+// fingerprint summarizes the names, sizes and modification times of the
+// template files and theme manifest, so any edit, new or deleted file
+// changes it
+func (r *Renderer) fingerprint() (string, error) {
+	var b bytes.Buffer
+	if info, err := fs.Stat(r.fsys, manifest); err == nil {
+		fmt.Fprintf(&b, "%s %d %d\n", manifest, info.Size(), info.ModTime().UnixNano())
+	}
+	err := fs.WalkDir(r.fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return b.String(), err
+}
+
+// parse parses every page together with the layouts and partials. Each page
+// gets its own template set because pages define the same blocks.
+func (r *Renderer) parse() (map[string]*template.Template, error) {
+	var shared []string
+	for _, pattern := range []string{dir + "/layouts/*.html", dir + "/partials/*.html"} {
+		files, err := fs.Glob(r.fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, files...)
+	}
+
+	files, err := fs.Glob(r.fsys, dir+"/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("views: no pages in " + dir)
+	}
+
+	pages := make(map[string]*template.Template, len(files))
+	for _, file := range files {
+		name := path.Base(file)
+		page, err := template.New(name).Funcs(r.helpers()).Funcs(r.funcs).
+			ParseFS(r.fsys, append(shared[:len(shared):len(shared)], file)...)
+		if err != nil {
+			return nil, err
+		}
+		if page.Lookup("base") == nil {
+			return nil, fmt.Errorf("views: no base layout for %s", name)
+		}
+		pages[name] = page
+	}
+
+	return pages, nil
+}